@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// romExtensions lists the file types that can be picked out of an archive.
+var romExtensions = []string{".nes", ".nsf", ".fds", ".unf"}
+
+func isROMName(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range romExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadROMFile reads a ROM image from file, which may be a plain image, a
+// gzip-compressed image (.gz) or a zip archive (.zip). An entry inside a
+// zip archive can be named with "archive.zip#inner.nes". It returns the
+// image and the name of the image file, which tells its format.
+func ReadROMFile(file string) ([]byte, string, error) {
+	archive, inner := splitArchivePath(file)
+
+	switch strings.ToLower(filepath.Ext(archive)) {
+	case ".zip":
+		return readZip(archive, inner)
+	case ".gz":
+		return readGzip(archive)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	return data, filepath.Base(file), err
+}
+
+// splitArchivePath splits "archive.zip#inner.nes" into its parts. Paths
+// that exist as given are never split.
+func splitArchivePath(file string) (string, string) {
+	i := strings.LastIndex(file, "#")
+	if i < 0 {
+		return file, ""
+	}
+	if _, err := os.Stat(file); err == nil {
+		return file, ""
+	}
+	return file[:i], file[i+1:]
+}
+
+func readZip(file, inner string) ([]byte, string, error) {
+	z, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, "", err
+	}
+	defer z.Close()
+
+	var candidates []*zip.File
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if inner != "" {
+			if f.Name == inner || path.Base(f.Name) == inner {
+				candidates = append(candidates, f)
+			}
+		} else if isROMName(f.Name) {
+			candidates = append(candidates, f)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		if inner != "" {
+			return nil, "", fmt.Errorf("%s: no entry named %q", file, inner)
+		}
+		return nil, "", &ArchiveError{file, nil}
+	case 1:
+	default:
+		names := make([]string, 0, len(candidates))
+		for _, f := range candidates {
+			names = append(names, f.Name)
+		}
+		return nil, "", &ArchiveError{file, names}
+	}
+
+	rc, err := candidates[0].Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	return data, path.Base(candidates[0].Name), err
+}
+
+func readGzip(file string) ([]byte, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, "", err
+	}
+	defer gz.Close()
+
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, "", err
+	}
+
+	name := gz.Name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return data, filepath.Base(name), nil
+}
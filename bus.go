@@ -3,6 +3,40 @@ package main
 type bus interface {
 	Get(uint16) byte
 	Set(uint16, byte)
+	// Peek returns what Get would, without side effects on the machine
+	// and without reporting the access.
+	Peek(uint16) byte
+}
+
+// Access is a kind of memory access.
+type Access int
+
+const (
+	AccessRead Access = 1 << iota
+	AccessWrite
+	AccessExecute
+)
+
+func (a Access) String() string {
+	s := ""
+	if a&AccessRead != 0 {
+		s += "r"
+	}
+	if a&AccessWrite != 0 {
+		s += "w"
+	}
+	if a&AccessExecute != 0 {
+		s += "x"
+	}
+	return s
+}
+
+// AccessHook is called with every read and write on a bus.
+type AccessHook func(addr uint16, value byte, access Access)
+
+// watchable is implemented by buses that report their accesses to a hook.
+type watchable interface {
+	SetAccessHook(AccessHook)
 }
 
 const (
@@ -25,25 +59,88 @@ const (
 	PPUAddressVRAM_Limit = 0x4000
 )
 
+const PPUNameTableSize = 0x400
+
 type ppuBus struct {
-	vram []byte
-	mmc  mmc
+	vram       []byte
+	mmc        mmc
+	mirroring  Mirroring
+	controller mirroringController
+	hook       AccessHook
+	cdl        *CDL
 }
 
-func NewPPUBus(vram []byte, mmc mmc) bus {
+func NewPPUBus(vram []byte, mmc mmc, mirroring Mirroring) bus {
+	controller, _ := mmc.(mirroringController)
 	return &ppuBus{
-		vram: vram,
-		mmc:  mmc,
+		vram:       vram,
+		mmc:        mmc,
+		mirroring:  mirroring,
+		controller: controller,
+	}
+}
+
+// nameTableIndex maps a nametable address ($2000-$3EFF) into vram
+// according to the cartridge's mirroring arrangement.
+func (b *ppuBus) nameTableIndex(addr uint16) uint16 {
+	offset := (addr - PPUAddressVRAM) % (4 * PPUNameTableSize)
+	table := offset / PPUNameTableSize
+	mirroring := b.mirroring
+	if b.controller != nil {
+		mirroring = b.controller.Mirroring()
 	}
+	switch mirroring {
+	case MirroringHorizontal:
+		table /= 2
+	case MirroringVertical:
+		table %= 2
+	case MirroringSingleScreen0:
+		table = 0
+	case MirroringSingleScreen1:
+		table = 1
+	}
+	return table*PPUNameTableSize + offset%PPUNameTableSize
+}
+
+func (b *ppuBus) SetAccessHook(hook AccessHook) {
+	b.hook = hook
+}
+
+func (b *ppuBus) SetCDL(c *CDL) {
+	b.cdl = c
 }
 
 func (b *ppuBus) Get(addr uint16) byte {
+	value := b.get(addr)
+	if b.cdl != nil && addr < PPUAddressVRAM {
+		b.cdl.logCHR(addr)
+	}
+	if b.hook != nil {
+		b.hook(addr, value, AccessRead)
+	}
+	return value
+}
+
+func (b *ppuBus) Peek(addr uint16) byte {
+	if addr < PPUAddressVRAM {
+		return b.mmc.Peek(addr)
+	}
+	return b.get(addr)
+}
+
+func (b *ppuBus) Set(addr uint16, val byte) {
+	if b.hook != nil {
+		b.hook(addr, val, AccessWrite)
+	}
+	b.set(addr, val)
+}
+
+func (b *ppuBus) get(addr uint16) byte {
 	switch {
 	case addr < PPUAddressVRAM:
 		return b.mmc.Get(addr)
 	case PPUAddressVRAM <= addr && addr < PPUAddressPaletteBG:
-		diff := uint16((addr - PPUAddressVRAM) % 0xF00)
-		return b.vram[diff]
+		return b.vram[b.nameTableIndex(addr)]
 	case PPUAddressPaletteBG <= addr:
 		diff := uint16((addr - PPUAddressPaletteBG) % 0x20)
 		base := uint16(PPUAddressPaletteBG - PPUAddressVRAM)
@@ -55,13 +152,12 @@ func (b *ppuBus) Get(addr uint16) byte {
 	}
 }
 
-func (b *ppuBus) Set(addr uint16, val byte) {
+func (b *ppuBus) set(addr uint16, val byte) {
 	switch {
 	case addr < PPUAddressVRAM:
 		b.mmc.Set(addr, val)
 	case PPUAddressVRAM <= addr && addr < PPUAddressPaletteBG:
-		diff := uint16((addr - PPUAddressVRAM) % 0xF00)
-		b.vram[diff] = val
+		b.vram[b.nameTableIndex(addr)] = val
 	case PPUAddressPaletteBG <= addr:
 		diff := uint16((addr - PPUAddressPaletteBG) % 0x20)
 		base := uint16(PPUAddressPaletteBG - PPUAddressVRAM)
@@ -100,22 +196,70 @@ const (
 )
 
 type cpuBus struct {
-	ppu  *ppu
-	apu  *apu
-	mmc  mmc
-	wram []byte
+	ppu         *ppu
+	apu         *apu
+	mmc         mmc
+	wram        []byte
+	controllers *[2]Controller
+	hook        AccessHook
+	cdl         *CDL
 }
 
-func NewCPUBus(wram []byte, ppu *ppu, apu *apu, mmc mmc) bus {
+func NewCPUBus(wram []byte, ppu *ppu, apu *apu, mmc mmc, controllers *[2]Controller) bus {
 	return &cpuBus{
-		wram: wram,
-		ppu:  ppu,
-		apu:  apu,
-		mmc:  mmc,
+		wram:        wram,
+		ppu:         ppu,
+		apu:         apu,
+		mmc:         mmc,
+		controllers: controllers,
 	}
 }
 
+func (b *cpuBus) SetAccessHook(hook AccessHook) {
+	b.hook = hook
+}
+
+func (b *cpuBus) SetCDL(c *CDL) {
+	b.cdl = c
+}
+
 func (b *cpuBus) Get(address uint16) byte {
+	value := b.get(address)
+	if b.cdl != nil {
+		b.cdl.logPRG(address)
+	}
+	if b.hook != nil {
+		b.hook(address, value, AccessRead)
+	}
+	return value
+}
+
+func (b *cpuBus) Peek(address uint16) byte {
+	switch {
+	case address == AddressPPUStatus:
+		return b.ppu.PeekStatus()
+	case address == AddressOAMData:
+		return b.ppu.PeekOAM()
+	case address == AddressPPUData:
+		return b.ppu.PeekData()
+	case address == AddressJoy1:
+		return b.controllers[0].Peek()
+	case address == AddressJoy2:
+		return b.controllers[1].Peek()
+	case address < AddressAPUTest:
+		return b.get(address)
+	}
+	return b.mmc.Peek(address)
+}
+
+func (b *cpuBus) Set(address uint16, value byte) {
+	if b.hook != nil {
+		b.hook(address, value, AccessWrite)
+	}
+	b.set(address, value)
+}
+
+func (b *cpuBus) get(address uint16) byte {
 	switch {
 	case address < AddressMirror1:
 		return b.wram[address]
@@ -138,20 +282,24 @@ func (b *cpuBus) Get(address uint16) byte {
 	case address == AddressPPUAddr:
 		return 0
 	case address == AddressPPUData:
+		if b.cdl != nil {
+			b.cdl.chrFlags = CDLRead
+			defer func() { b.cdl.chrFlags = CDLRendered }()
+		}
 		return b.ppu.GetData()
 	case address == AddressOAMDMA:
 		return 0
 	case address == AddressAPUStatus:
 		return b.apu.Status
 	case address == AddressJoy1:
-		return 0
-	case address == AddressAPUFrameCounter:
-		return b.apu.FrameCounter
+		return b.controllers[0].Read()
+	case address == AddressJoy2:
+		return b.controllers[1].Read()
 	}
 	return b.mmc.Get(address)
 }
 
-func (b *cpuBus) Set(address uint16, value byte) {
+func (b *cpuBus) set(address uint16, value byte) {
 	switch {
 	case address < AddressMirror1:
 		b.wram[address] = value
@@ -178,7 +326,8 @@ func (b *cpuBus) Set(address uint16, value byte) {
 	case address == AddressAPUStatus:
 		b.apu.Status = value
 	case address == AddressJoy1:
-		// nop
+		b.controllers[0].Write(value)
+		b.controllers[1].Write(value)
 	case address == AddressAPUFrameCounter:
 		b.apu.FrameCounter = value
 	default:
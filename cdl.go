@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// PRG flags of the FCEUX code/data log format. Bits 2-3 hold which 8KB
+// window of $8000-$FFFF the byte was last seen at.
+const (
+	CDLCode         = 0x01
+	CDLData         = 0x02
+	CDLIndirectCode = 0x10
+	CDLIndirectData = 0x20
+	CDLPCM          = 0x40
+
+	cdlWindowShift = 2
+)
+
+// CHR flags
+const (
+	CDLRendered = 0x01
+	CDLRead     = 0x02
+)
+
+// CDL logs how each PRG-ROM and CHR-ROM byte is used. Logging happens on
+// the CPU and PPU buses, which map each access to a ROM offset through
+// the mapper's PRGOffset and CHROffset, so bytes are tracked across bank
+// switches; the CPU sets the flags for the access it is about to make. A
+// .cdl file is the PRG flags followed by the CHR flags.
+//
+// CDLPCM is never set, as the APU has no DMC sample fetches yet.
+type CDL struct {
+	PRG []byte
+	CHR []byte
+
+	mmc mmc
+	// flags given to PRG and CHR reads, set by the CPU and the bus
+	// according to what is being read
+	prgFlags byte
+	chrFlags byte
+}
+
+func NewCDL(r *rom, m mmc) *CDL {
+	c := &CDL{
+		PRG:      make([]byte, len(r.PRG)),
+		mmc:      m,
+		prgFlags: CDLData,
+		chrFlags: CDLRendered,
+	}
+	if r.Header.CHRROMSize > 0 {
+		c.CHR = make([]byte, len(r.CHR))
+	}
+	return c
+}
+
+// cdlLogger is implemented by buses that report ROM reads to a CDL.
+type cdlLogger interface {
+	SetCDL(*CDL)
+}
+
+// SetCDL starts logging to c, or stops with nil.
+func (n *NES) SetCDL(c *CDL) {
+	n.CDL = c
+	n.CPU.cdl = c
+	for _, b := range []bus{n.CPUBus, n.PPUBus} {
+		if l, ok := b.(cdlLogger); ok {
+			l.SetCDL(c)
+		}
+	}
+}
+
+// logPRG records a CPU read of addr.
+func (c *CDL) logPRG(addr uint16) {
+	offset := prgOffset(c.mmc, addr)
+	if offset < 0 || offset >= len(c.PRG) {
+		return
+	}
+	window := byte(addr>>13&0x03) << cdlWindowShift
+	c.PRG[offset] = c.PRG[offset]&^(0x03<<cdlWindowShift) | window | c.prgFlags
+}
+
+// logCHR records a PPU read of addr.
+func (c *CDL) logCHR(addr uint16) {
+	offset := chrOffset(c.mmc, addr)
+	if offset < 0 || offset >= len(c.CHR) {
+		return
+	}
+	c.CHR[offset] |= c.chrFlags
+}
+
+// Load merges a .cdl file into c.
+func (c *CDL) Load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(data) != len(c.PRG)+len(c.CHR) {
+		return &SizeMismatchError{len(c.PRG) + len(c.CHR), len(data)}
+	}
+	for i := range c.PRG {
+		c.PRG[i] |= data[i]
+	}
+	for i := range c.CHR {
+		c.CHR[i] |= data[len(c.PRG)+i]
+	}
+	return nil
+}
+
+// Save writes c as a .cdl file, crash-safely like battery saves.
+func (c *CDL) Save(file string) error {
+	data := make([]byte, 0, len(c.PRG)+len(c.CHR))
+	data = append(data, c.PRG...)
+	data = append(data, c.CHR...)
+	return writeSave(file, data)
+}
+
+// CDLStats counts logged bytes.
+type CDLStats struct {
+	PRG, Code, Data, PRGUnused     int
+	CHR, Rendered, Read, CHRUnused int
+}
+
+func (c *CDL) Stats() CDLStats {
+	s := CDLStats{PRG: len(c.PRG), CHR: len(c.CHR)}
+	for _, f := range c.PRG {
+		if f&(CDLCode|CDLIndirectCode) != 0 {
+			s.Code++
+		}
+		if f&(CDLData|CDLIndirectData|CDLPCM) != 0 {
+			s.Data++
+		}
+		if f&^(0x03<<cdlWindowShift) == 0 {
+			s.PRGUnused++
+		}
+	}
+	for _, f := range c.CHR {
+		if f&CDLRendered != 0 {
+			s.Rendered++
+		}
+		if f&CDLRead != 0 {
+			s.Read++
+		}
+		if f == 0 {
+			s.CHRUnused++
+		}
+	}
+	return s
+}
+
+// Strip returns a copy of an iNES image with every PRG-ROM and CHR-ROM
+// byte the log never saw cleared to zero.
+func (c *CDL) Strip(image []byte) ([]byte, error) {
+	var raw [HeaderSize]byte
+	if len(image) < HeaderSize {
+		return nil, &TruncatedError{"header", HeaderSize, len(image)}
+	}
+	copy(raw[:], image)
+	header, err := ParseHeader(raw)
+	if err != nil {
+		return nil, err
+	}
+	prg := HeaderSize
+	if header.Trainer {
+		prg += 512
+	}
+	chr := prg + header.PRGROMSize
+	if len(image) < chr+header.CHRROMSize {
+		return nil, &TruncatedError{"ROM", chr + header.CHRROMSize, len(image)}
+	}
+	if header.PRGROMSize != len(c.PRG) || header.CHRROMSize != len(c.CHR) {
+		return nil, &SizeMismatchError{len(c.PRG) + len(c.CHR), header.PRGROMSize + header.CHRROMSize}
+	}
+
+	out := append([]byte(nil), image...)
+	for i, f := range c.PRG {
+		if f&^(0x03<<cdlWindowShift) == 0 {
+			out[prg+i] = 0
+		}
+	}
+	for i, f := range c.CHR {
+		if f == 0 {
+			out[chr+i] = 0
+		}
+	}
+	return out, nil
+}
+
+// cdlCommand reports the coverage of a .cdl file and strips unused
+// bytes from the ROM.
+func cdlCommand(args []string) error {
+	fs := flag.NewFlagSet("cdl", flag.ExitOnError)
+	configFlags := NewConfigFlags(fs)
+	cdlFile := fs.String("cdl", "", "code/data log (default: the ROM name with .cdl)")
+	strip := fs.String("strip", "", "write the ROM with unused bytes cleared to this file")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: nes cdl [flags] rom.nes")
+	}
+
+	config, err := configFlags.Config()
+	if err != nil {
+		return err
+	}
+	r, err := LoadROM(fs.Arg(0), config)
+	if err != nil {
+		return err
+	}
+	if *cdlFile == "" {
+		*cdlFile = CDLPath(fs.Arg(0))
+	}
+
+	c := NewCDL(r, NewMMC(r.Header.MapperNum, r))
+	if err := c.Load(*cdlFile); err != nil {
+		return err
+	}
+
+	s := c.Stats()
+	percent := func(n, total int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(total)
+	}
+	fmt.Printf("PRG:      %d bytes\n", s.PRG)
+	fmt.Printf("  code:   %d (%.1f%%)\n", s.Code, percent(s.Code, s.PRG))
+	fmt.Printf("  data:   %d (%.1f%%)\n", s.Data, percent(s.Data, s.PRG))
+	fmt.Printf("  unused: %d (%.1f%%)\n", s.PRGUnused, percent(s.PRGUnused, s.PRG))
+	if s.CHR > 0 {
+		fmt.Printf("CHR:      %d bytes\n", s.CHR)
+		fmt.Printf("  drawn:  %d (%.1f%%)\n", s.Rendered, percent(s.Rendered, s.CHR))
+		fmt.Printf("  read:   %d (%.1f%%)\n", s.Read, percent(s.Read, s.CHR))
+		fmt.Printf("  unused: %d (%.1f%%)\n", s.CHRUnused, percent(s.CHRUnused, s.CHR))
+	}
+
+	if *strip == "" {
+		return nil
+	}
+	image, _, err := ReadROMFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	stripped, err := c.Strip(image)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*strip, stripped, 0644)
+}
+
+// CDLPath returns the default code/data log file of a ROM.
+func CDLPath(romFile string) string {
+	archive, _ := splitArchivePath(romFile)
+	return strings.TrimSuffix(SavePath(archive, ""), ".sav") + ".cdl"
+}
+
+// StartCDL logs to a new CDL, merging in file if it exists.
+func (n *NES) StartCDL(file string) error {
+	c := NewCDL(n.ROM, n.MMC)
+	if err := c.Load(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	n.SetCDL(c)
+	return nil
+}
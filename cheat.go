@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// SearchOp compares a candidate's value in a cheat search.
+type SearchOp int
+
+const (
+	SearchEqual SearchOp = iota
+	SearchNotEqual
+	SearchGreater
+	SearchLess
+	// SearchChangedBy keeps values that changed by exactly the operand
+	// since the last snapshot.
+	SearchChangedBy
+)
+
+var searchOpNames = map[string]SearchOp{
+	"=":  SearchEqual,
+	"==": SearchEqual,
+	"!=": SearchNotEqual,
+	">":  SearchGreater,
+	"<":  SearchLess,
+}
+
+func ParseSearchOp(s string) (SearchOp, bool) {
+	op, ok := searchOpNames[s]
+	return op, ok
+}
+
+// CheatCandidate is a value a cheat search has not ruled out yet.
+type CheatCandidate struct {
+	Space Space
+	Addr  int
+	// Value is the value at the last snapshot, Previous the one before.
+	Value    int
+	Previous int
+}
+
+// CheatSearch narrows down where a game keeps a value, like the number
+// of lives, by comparing snapshots of work RAM and PRG-RAM.
+type CheatSearch struct {
+	nes        *NES
+	Format     WatchFormat
+	candidates []CheatCandidate
+}
+
+// NewCheatSearch starts a search over every value of format in work RAM
+// and PRG-RAM, taking the first snapshot.
+func NewCheatSearch(n *NES, format WatchFormat) *CheatSearch {
+	s := &CheatSearch{nes: n, Format: format}
+	add := func(space Space, size int) {
+		for addr := 0; addr+format.Size() <= size; addr++ {
+			v := n.PeekValue(space, addr, format)
+			s.candidates = append(s.candidates, CheatCandidate{space, addr, v, v})
+		}
+	}
+	add(SpaceCPU, len(n.wram))
+	add(SpacePRGRAM, len(n.ROM.PRGRAM))
+	return s
+}
+
+// Filter takes a snapshot and keeps the candidates whose value compares
+// with op to operand when literal is set, or else to their value in the
+// last snapshot. It returns the number of candidates left.
+func (s *CheatSearch) Filter(op SearchOp, operand int, literal bool) int {
+	kept := s.candidates[:0]
+	for _, c := range s.candidates {
+		v := s.nes.PeekValue(c.Space, c.Addr, s.Format)
+		ref := c.Value
+		if literal {
+			ref = operand
+		}
+		var match bool
+		switch op {
+		case SearchEqual:
+			match = v == ref
+		case SearchNotEqual:
+			match = v != ref
+		case SearchGreater:
+			match = v > ref
+		case SearchLess:
+			match = v < ref
+		case SearchChangedBy:
+			match = v-c.Value == operand
+		}
+		if match {
+			c.Previous, c.Value = c.Value, v
+			kept = append(kept, c)
+		}
+	}
+	s.candidates = kept
+	return len(kept)
+}
+
+// Snapshot refreshes the values of the candidates without ruling any
+// out.
+func (s *CheatSearch) Snapshot() {
+	for i := range s.candidates {
+		c := &s.candidates[i]
+		c.Previous, c.Value = c.Value, s.nes.PeekValue(c.Space, c.Addr, s.Format)
+	}
+}
+
+func (s *CheatSearch) Candidates() []CheatCandidate {
+	return s.candidates
+}
+
+// Write lists up to max candidates.
+func (s *CheatSearch) Write(w io.Writer, max int) {
+	for i, c := range s.candidates {
+		if i == max {
+			fmt.Fprintf(w, "... %d more\n", len(s.candidates)-max)
+			break
+		}
+		fmt.Fprintf(w, "%4d  %-6s $%04X %6d (was %d)\n", i, c.Space, c.Addr, c.Value, c.Previous)
+	}
+}
+
+// Promote turns a candidate into a RAM cheat: a watch frozen at value,
+// applied every frame.
+func (s *CheatSearch) Promote(c CheatCandidate, value int, name string) *Watch {
+	n := s.nes
+	if n.Watches == nil {
+		n.Watches = NewWatchList()
+	}
+	w := n.Watches.Add(c.Space, c.Addr, s.Format, name)
+	n.Watches.Freeze(n, w, value)
+	return w
+}
+
+// FreezeSpec returns w as an argument for nes run -freeze.
+func (w *Watch) FreezeSpec() string {
+	spec := fmt.Sprintf("%s:$%04X:%s", w.Space, w.Addr, w.Format)
+	if w.Name != "" {
+		spec += ":" + w.Name
+	}
+	return fmt.Sprintf("%s=%d", spec, w.FrozenValue)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+type Config struct {
+	// SaveDir is where battery saves are kept. Empty means next to the ROM.
+	SaveDir string
+	// PatchFile is an IPS/UPS/BPS patch applied on load. Empty means a
+	// patch next to the ROM with the same base name, if any.
+	PatchFile string
+	// DBPolicy decides between the header and the game database.
+	DBPolicy DBPolicy
+	// FDSBIOS is the disk system BIOS. Empty means disksys.rom next to
+	// the disk image.
+	FDSBIOS string
+}
+
+// ConfigFlags registers the flags shared by every command that loads a
+// ROM. Call Config after parsing.
+type ConfigFlags struct {
+	saveDir    *string
+	patch      *string
+	dbPolicy   *string
+	gameDBFile *string
+	fdsBIOS    *string
+}
+
+func NewConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	return &ConfigFlags{
+		saveDir:    fs.String("savedir", "", "directory for battery saves (default: next to the ROM)"),
+		patch:      fs.String("patch", "", "IPS/UPS/BPS patch to apply (default: same name as the ROM)"),
+		dbPolicy:   fs.String("dbpolicy", "warn", "header/database conflicts: header, database or warn"),
+		gameDBFile: fs.String("gamedb", "", "additional game database file, or nes20db.xml (default: nes/nes20db.xml in the user config directory, if present)"),
+		fdsBIOS:    fs.String("fdsbios", "", "Famicom Disk System BIOS (default: disksys.rom next to the image)"),
+	}
+}
+
+func (f *ConfigFlags) Config() (Config, error) {
+	policy, err := ParseDBPolicy(*f.dbPolicy)
+	if err != nil {
+		return Config{}, err
+	}
+	if *f.gameDBFile != "" {
+		if err := LoadGameDBFile(*f.gameDBFile); err != nil {
+			return Config{}, err
+		}
+	} else if file := DefaultGameDBFile(); file != "" {
+		if _, err := os.Stat(file); err == nil {
+			if err := LoadGameDBFile(file); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+	return Config{
+		SaveDir:   *f.saveDir,
+		PatchFile: *f.patch,
+		DBPolicy:  policy,
+		FDSBIOS:   *f.fdsBIOS,
+	}, nil
+}
@@ -1,3 +1,48 @@
 package main
 
-type Controller struct {}
+// controller buttons, in the order they are shifted out
+const (
+	ButtonA = 1 << iota
+	ButtonB
+	ButtonSelect
+	ButtonStart
+	ButtonUp
+	ButtonDown
+	ButtonLeft
+	ButtonRight
+)
+
+type Controller struct {
+	Buttons byte
+	index   byte
+	strobe  bool
+}
+
+func (c *Controller) Read() byte {
+	var v byte
+	if c.index < 8 && c.Buttons&(1<<c.index) != 0 {
+		v = 1
+	} else if c.index >= 8 {
+		// official controllers report 1 after all buttons are read
+		v = 1
+	}
+	if !c.strobe && c.index < 8 {
+		c.index++
+	}
+	return v
+}
+
+// Peek returns what Read would, without shifting.
+func (c *Controller) Peek() byte {
+	if c.index >= 8 || c.Buttons&(1<<c.index) != 0 {
+		return 1
+	}
+	return 0
+}
+
+func (c *Controller) Write(v byte) {
+	c.strobe = v&1 != 0
+	if c.strobe {
+		c.index = 0
+	}
+}
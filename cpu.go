@@ -1,11 +1,8 @@
 package main
 
-import (
-	"fmt"
-	//"log"
-)
-
 const CPUFrequency = 1789773
+const CPUFrequencyPAL = 1662607
+const CPUFrequencyDendy = 1773448
 const CPUStackStart = 0x0100
 
 // interrupt types
@@ -55,6 +52,48 @@ var instruction_modes = [256]int{
 	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
 }
 
+// instruction_cycles indicates the number of cycles used by each instruction,
+// not including conditional cycles
+var instruction_cycles = [256]int{
+	7, 6, 2, 8, 3, 3, 5, 5, 3, 2, 2, 2, 4, 4, 6, 6,
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7,
+	6, 6, 2, 8, 3, 3, 5, 5, 4, 2, 2, 2, 4, 4, 6, 6,
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7,
+	6, 6, 2, 8, 3, 3, 5, 5, 3, 2, 2, 2, 3, 4, 6, 6,
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7,
+	6, 6, 2, 8, 3, 3, 5, 5, 4, 2, 2, 2, 5, 4, 6, 6,
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7,
+	2, 6, 2, 6, 3, 3, 3, 3, 2, 2, 2, 2, 4, 4, 4, 4,
+	2, 6, 2, 6, 4, 4, 4, 4, 2, 5, 2, 5, 5, 5, 5, 5,
+	2, 6, 2, 6, 3, 3, 3, 3, 2, 2, 2, 2, 4, 4, 4, 4,
+	2, 5, 2, 5, 4, 4, 4, 4, 2, 4, 2, 4, 4, 4, 4, 4,
+	2, 6, 2, 8, 3, 3, 5, 5, 2, 2, 2, 2, 4, 4, 6, 6,
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7,
+	2, 6, 2, 8, 3, 3, 5, 5, 2, 2, 2, 2, 4, 4, 6, 6,
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7,
+}
+
+// instruction_page_cycles indicates the number of cycles used by each
+// instruction when a page is crossed
+var instruction_page_cycles = [256]int{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1, 1, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1, 1, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1, 1, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1, 1, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 1, 1, 1, 1,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1, 1, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1, 1, 0, 0,
+}
+
 // instruction_sizes indicates the size of each instruction in bytes
 var instruction_sizes = [256]int{
 	1, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
@@ -172,10 +211,23 @@ type cpu struct {
 	interrupt int
 	Cycle     int
 	bus       bus
+
+	// cycles taken by the current instruction
+	cycles int
+
+	tracer *Tracer
+
+	cdl          *CDL
+	indirectJump bool
+
+	profiler *Profiler
 }
 
-func (c *cpu) Tick() {
-	c.Cycle++
+// Tick executes one instruction and returns the number of cycles it took.
+func (c *cpu) Tick() int {
+	c.cycles = 0
+	// the interrupt taken before this instruction, for the profiler
+	entered := interruptNone
 	switch c.interrupt {
 	case interruptNMI:
 		c.pushAddress(c.PC)
@@ -183,6 +235,8 @@ func (c *cpu) Tick() {
 		c.setStatusFlag(FlagI, true)
 		c.setStatusFlag(FlagB, false)
 		c.PC = c.getAddress(0xFFFA)
+		c.cycles += 7
+		entered = interruptNMI
 	case interruptIRQ:
 		if !c.getStatusFlagBool(FlagI) {
 			c.pushAddress(c.PC)
@@ -190,6 +244,8 @@ func (c *cpu) Tick() {
 			c.setStatusFlag(FlagI, true)
 			c.setStatusFlag(FlagB, false)
 			c.PC = c.getAddress(0xFFFE)
+			c.cycles += 7
+			entered = interruptIRQ
 		}
 	case interruptBRK:
 		if !c.getStatusFlagBool(FlagI) {
@@ -199,25 +255,40 @@ func (c *cpu) Tick() {
 			c.push(c.P)
 			c.setStatusFlag(FlagI, true)
 			c.PC = c.getAddress(0xFFFE)
+			entered = interruptBRK
 		}
 	}
 	c.interrupt = interruptNone
 
-	output := fmt.Sprintf("PC:%04x ", c.PC)
+	if c.tracer != nil {
+		c.tracer.Trace(c)
+	}
 
+	if c.cdl != nil {
+		c.cdl.prgFlags = CDLCode
+		if c.indirectJump {
+			c.cdl.prgFlags |= CDLIndirectCode
+		}
+	}
+	pc, sp := c.PC, c.S
 	opecode := c.bus.Get(c.PC)
 	c.PC += 1
 
 	mode := instruction_modes[opecode]
 
 	var address uint16
+	var pageCrossed bool
 	switch mode {
 	case modeAbsolute:
 		address = c.getAddress(c.PC)
 	case modeAbsoluteX:
-		address = c.getAddress(c.PC) + uint16(c.X)
+		base := c.getAddress(c.PC)
+		address = base + uint16(c.X)
+		pageCrossed = pagesDiffer(base, address)
 	case modeAbsoluteY:
-		address = c.getAddress(c.PC) + uint16(c.Y)
+		base := c.getAddress(c.PC)
+		address = base + uint16(c.Y)
+		pageCrossed = pagesDiffer(base, address)
 	case modeAccumulator:
 		address = 0
 	case modeImmediate:
@@ -227,9 +298,15 @@ func (c *cpu) Tick() {
 	case modeIndexedIndirect:
 		address = c.getAddress(uint16(c.bus.Get(c.PC) + c.X))
 	case modeIndirect:
-		address = c.getAddress(c.getAddress(c.PC))
+		pointer := c.getAddress(c.PC)
+		if c.cdl != nil {
+			c.cdl.prgFlags = CDLData
+		}
+		address = c.getAddress(pointer)
 	case modeIndirectIndexed:
-		address = c.getAddress(uint16(c.bus.Get(c.PC))) + uint16(c.Y)
+		base := c.getAddress(uint16(c.bus.Get(c.PC)))
+		address = base + uint16(c.Y)
+		pageCrossed = pagesDiffer(base, address)
 	case modeRelative:
 		offset := uint16(c.bus.Get(c.PC))
 		if offset < 0x80 {
@@ -247,19 +324,51 @@ func (c *cpu) Tick() {
 
 	c.PC += uint16(instruction_sizes[opecode] - 1)
 
+	c.cycles += instruction_cycles[opecode]
+	if pageCrossed {
+		c.cycles += instruction_page_cycles[opecode]
+	}
+
+	if c.cdl != nil {
+		switch mode {
+		case modeImmediate:
+			// the operand is part of the code
+		case modeIndexedIndirect, modeIndirectIndexed:
+			c.cdl.prgFlags = CDLData | CDLIndirectData
+		default:
+			c.cdl.prgFlags = CDLData
+		}
+		c.indirectJump = mode == modeIndirect
+	}
 	instructions[opecode](c, address, mode)
-	output += fmt.Sprintf(
-		"OP:%s(%04x) %04x A:%02x X:%02x Y:%02x P:%02x SP:%02x",
-		instruction_names[opecode],
-		opecode,
-		address,
-		c.A,
-		c.X,
-		c.Y,
-		c.P,
-		c.S,
-	)
-	//log.Println(output)
+
+	if c.profiler != nil {
+		c.profiler.instruction(c, entered, pc, sp, opecode)
+	}
+
+	c.Cycle += c.cycles
+	return c.cycles
+}
+
+func pagesDiffer(a, b uint16) bool {
+	return a&0xFF00 != b&0xFF00
+}
+
+// branch jumps to addr, taking one more cycle, or two when the branch
+// lands on another page.
+func (c *cpu) branch(addr uint16) {
+	c.cycles++
+	if pagesDiffer(c.PC, addr) {
+		c.cycles++
+	}
+	c.PC = addr
+}
+
+// TriggerIRQ asserts the IRQ line for the next instruction.
+func (c *cpu) TriggerIRQ() {
+	if c.interrupt == interruptNone {
+		c.interrupt = interruptIRQ
+	}
 }
 
 func (c *cpu) PowerOn() {
@@ -390,17 +499,17 @@ func asl(c *cpu, addr uint16, mode int) {
 }
 func bcc(c *cpu, addr uint16, mode int) {
 	if !c.getStatusFlagBool(FlagC) {
-		c.PC = addr
+		c.branch(addr)
 	}
 }
 func bcs(c *cpu, addr uint16, mode int) {
 	if c.getStatusFlagBool(FlagC) {
-		c.PC = addr
+		c.branch(addr)
 	}
 }
 func beq(c *cpu, addr uint16, mode int) {
 	if c.getStatusFlagBool(FlagZ) {
-		c.PC = addr
+		c.branch(addr)
 	}
 }
 func bit(c *cpu, addr uint16, mode int) {
@@ -411,17 +520,17 @@ func bit(c *cpu, addr uint16, mode int) {
 }
 func bmi(c *cpu, addr uint16, mode int) {
 	if c.getStatusFlagBool(FlagN) {
-		c.PC = addr
+		c.branch(addr)
 	}
 }
 func bne(c *cpu, addr uint16, mode int) {
 	if !c.getStatusFlagBool(FlagZ) {
-		c.PC = addr
+		c.branch(addr)
 	}
 }
 func bpl(c *cpu, addr uint16, mode int) {
 	if !c.getStatusFlagBool(FlagN) {
-		c.PC = addr
+		c.branch(addr)
 	}
 }
 func brk(c *cpu, addr uint16, mode int) {
@@ -429,12 +538,12 @@ func brk(c *cpu, addr uint16, mode int) {
 }
 func bvc(c *cpu, addr uint16, mode int) {
 	if !c.getStatusFlagBool(FlagV) {
-		c.PC = addr
+		c.branch(addr)
 	}
 }
 func bvs(c *cpu, addr uint16, mode int) {
 	if c.getStatusFlagBool(FlagV) {
-		c.PC = addr
+		c.branch(addr)
 	}
 }
 func clc(c *cpu, addr uint16, mode int) {
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+const debugHelp = `commands:
+  r, regs                     show registers
+  s, step [n]                 step into n instructions
+  n, next                     step over a JSR
+  out                         run until the current subroutine returns
+  c, continue                 run until a breakpoint or watchpoint
+  line N                      run until the PPU reaches scanline N
+  frame [n]                   run until the end of the frame, n times
+  input [BUTTONS [BUTTONS2]]  hold buttons, e.g. "a,right" ("-" for none)
+  b ADDR [if COND]            break at ADDR, a hex address or a symbol
+  w [rwx] [ppu] ADDR[-END] [if COND]
+                              watch accesses (default rw, cpu space)
+  d ID                        delete a breakpoint or watchpoint
+  l, list                     list breakpoints and watchpoints
+  m [SPACE] ADDR [LEN]        dump memory without side effects
+  e [SPACE] ADDR VALUE...     write memory
+  ram                         show the RAM watch
+  ram add [SPACE:]ADDR[:FMT[:NAME]]
+                              watch a value (FMT u8 s8 u16 s16 bcd8 bcd16)
+  ram del ID                  stop watching a value
+  ram freeze ID [VALUE]       hold a value, at its current one by default
+  ram thaw ID                 stop holding a value
+  stack                       dump the stack
+  u [ADDR] [N]                disassemble, around PC by default
+  cs new [FMT]                start a cheat search over RAM (default u8)
+  cs OP [VALUE]               keep values that are == != > < than VALUE,
+                              or than at the last search step
+  cs +N, cs -N                keep values that changed by N
+  cs snap                     take a snapshot without filtering
+  cs list [N]                 list the first N candidates (default 20)
+  cs keep I VALUE [NAME]      freeze candidate I at VALUE as a RAM cheat
+  reset                       press reset
+  q, quit                     quit
+spaces are cpu (default), ppu, oam, pal and prgram.
+conditions compare A X Y S P PC LINE DOT FRAME VALUE and numbers
+with == != < <= > >=, joined by &&; e.g. "A == $10 && X > 2".
+an empty line repeats the last command; ^C stops a running machine.`
+
+// debugCommand runs a ROM under an interactive debugger.
+func debugCommand(args []string) error {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	configFlags := NewConfigFlags(fs)
+	symbolFiles := fs.String("symbols", "", "comma-separated .dbg, .mlb or .nl files (default: found next to the ROM)")
+	gdbAddr := fs.String("gdb", "", "serve the GDB remote protocol on this address (e.g. localhost:2345) instead of the REPL")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: nes debug [flags] rom.nes")
+	}
+
+	config, err := configFlags.Config()
+	if err != nil {
+		return err
+	}
+	nes, err := NewNES(fs.Arg(0), NewFrameBuffer(), config)
+	if err != nil {
+		return err
+	}
+	nes.PowerOn()
+
+	d := NewDebugger(nes)
+	defer d.Detach()
+	if d.Symbols, err = LoadSymbolFiles(splitList(*symbolFiles), fs.Arg(0)); err != nil {
+		return err
+	}
+
+	if *gdbAddr != "" {
+		return NewGDBServer(d).ListenAndServe(*gdbAddr)
+	}
+
+	// ^C stops the machine instead of quitting
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		for range interrupts {
+			d.Interrupt()
+		}
+	}()
+
+	repl := &debugREPL{d: d, out: os.Stdout}
+	return repl.Run(os.Stdin)
+}
+
+type debugREPL struct {
+	d      *Debugger
+	out    io.Writer
+	search *CheatSearch
+}
+
+func (r *debugREPL) Run(in io.Reader) error {
+	fmt.Fprintln(r.out, `type "help" for commands`)
+	r.where()
+
+	scanner := bufio.NewScanner(in)
+	last := ""
+	for {
+		fmt.Fprint(r.out, "(nes) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(r.out)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			line = last
+		}
+		if line == "" {
+			continue
+		}
+		last = line
+		quit, err := r.exec(line)
+		if err != nil {
+			fmt.Fprintf(r.out, "error: %v\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+func (r *debugREPL) exec(line string) (bool, error) {
+	d := r.d
+	n := d.nes
+	args := strings.Fields(line)
+	cmd, args := args[0], args[1:]
+
+	switch cmd {
+	case "help", "h", "?":
+		fmt.Fprintln(r.out, debugHelp)
+	case "q", "quit", "exit":
+		return true, nil
+	case "r", "regs":
+		r.regs()
+	case "s", "step":
+		count := 1
+		if len(args) > 0 {
+			v, err := parseNumber(args[0])
+			if err != nil || v < 1 {
+				return false, fmt.Errorf("bad count %q", args[0])
+			}
+			count = v
+		}
+		for i := 0; i < count; i++ {
+			stop := d.StepInto()
+			if stop.Reason != "stepped" {
+				r.stopped(stop)
+				return false, nil
+			}
+		}
+		r.where()
+	case "n", "next":
+		r.stopped(d.StepOver())
+	case "out", "finish":
+		r.stopped(d.StepOut())
+	case "c", "continue":
+		r.stopped(d.Continue())
+	case "line":
+		if len(args) != 1 {
+			return false, errors.New("usage: line N")
+		}
+		v, err := parseNumber(args[0])
+		if err != nil {
+			return false, err
+		}
+		r.stopped(d.RunToScanline(v))
+	case "frame":
+		count := 1
+		if len(args) > 0 {
+			v, err := parseNumber(args[0])
+			if err != nil {
+				return false, err
+			}
+			count = v
+		}
+		stop := d.RunFrame()
+		for i := 1; i < count && stop.Breakpoint == nil && stop.Watchpoint == nil && stop.Reason != StopInterrupted; i++ {
+			stop = d.RunFrame()
+		}
+		r.stopped(stop)
+	case "input":
+		var buttons [2]byte
+		if len(args) > 2 {
+			return false, errors.New("usage: input [BUTTONS [BUTTONS2]]")
+		}
+		for i, arg := range args {
+			b, err := parseButtons(arg)
+			if err != nil {
+				return false, err
+			}
+			buttons[i] = b
+		}
+		n.Controllers[0].Buttons = buttons[0]
+		n.Controllers[1].Buttons = buttons[1]
+	case "cs":
+		return false, r.cheatSearch(args)
+	case "b", "break":
+		args, cond, err := splitCondition(args)
+		if err != nil {
+			return false, err
+		}
+		if len(args) != 1 {
+			return false, errors.New("usage: b ADDR [if COND]")
+		}
+		addr, err := r.d.Address(args[0])
+		if err != nil {
+			return false, err
+		}
+		b := d.AddBreakpoint(addr, cond)
+		fmt.Fprintf(r.out, "breakpoint %d at $%04X\n", b.ID, b.Addr)
+	case "w", "watch":
+		return false, r.watch(args)
+	case "d", "delete":
+		if len(args) != 1 {
+			return false, errors.New("usage: d ID")
+		}
+		id, err := parseNumber(args[0])
+		if err != nil {
+			return false, err
+		}
+		return false, d.Delete(id)
+	case "l", "list":
+		for _, b := range d.Breakpoints() {
+			fmt.Fprintf(r.out, "%3d  break  $%04X", b.ID, b.Addr)
+			if b.Condition != nil {
+				fmt.Fprintf(r.out, " if %v", b.Condition)
+			}
+			fmt.Fprintln(r.out)
+		}
+		for _, w := range d.Watchpoints() {
+			fmt.Fprintf(r.out, "%3d  watch  %s %-3s $%04X-$%04X", w.ID, w.Space, w.Access, w.Start, w.End)
+			if w.Condition != nil {
+				fmt.Fprintf(r.out, " if %v", w.Condition)
+			}
+			fmt.Fprintln(r.out)
+		}
+	case "m", "mem":
+		space := SpaceCPU
+		if len(args) > 0 {
+			if sp, ok := ParseSpace(args[0]); ok {
+				space, args = sp, args[1:]
+			}
+		}
+		if len(args) < 1 || len(args) > 2 {
+			return false, errors.New("usage: m [SPACE] ADDR [LEN]")
+		}
+		addr, err := r.d.Address(args[0])
+		if err != nil {
+			return false, err
+		}
+		length := 0x40
+		if len(args) == 2 {
+			if length, err = parseNumber(args[1]); err != nil {
+				return false, err
+			}
+		}
+		n.HexDump(r.out, space, int(addr), length)
+	case "e", "edit":
+		space := SpaceCPU
+		if len(args) > 0 {
+			if sp, ok := ParseSpace(args[0]); ok {
+				space, args = sp, args[1:]
+			}
+		}
+		if len(args) < 2 {
+			return false, errors.New("usage: e [SPACE] ADDR VALUE...")
+		}
+		addr, err := r.d.Address(args[0])
+		if err != nil {
+			return false, err
+		}
+		for i, arg := range args[1:] {
+			v, err := parseNumber(arg)
+			if err != nil {
+				return false, err
+			}
+			n.Poke(space, int(addr)+i, byte(v))
+		}
+		n.HexDump(r.out, space, int(addr), len(args)-1)
+	case "ram":
+		return false, r.ram(args)
+	case "stack":
+		s := int(n.CPU.S)
+		n.HexDump(r.out, SpaceCPU, CPUStackStart+s+1, 0xFF-s)
+	case "u", "disasm":
+		return false, r.disasm(args)
+	case "reset":
+		n.Reset()
+		r.where()
+	default:
+		return false, fmt.Errorf("unknown command %q", cmd)
+	}
+	return false, nil
+}
+
+// splitCondition splits "... if COND" into the arguments before "if"
+// and the parsed condition.
+func splitCondition(args []string) ([]string, *Condition, error) {
+	for i, arg := range args {
+		if arg == "if" {
+			cond, err := ParseCondition(strings.Join(args[i+1:], " "))
+			return args[:i], cond, err
+		}
+	}
+	return args, nil, nil
+}
+
+func (r *debugREPL) watch(args []string) error {
+	args, cond, err := splitCondition(args)
+	if err != nil {
+		return err
+	}
+	access := AccessRead | AccessWrite
+	space := SpaceCPU
+	for len(args) > 1 {
+		switch {
+		case args[0] == "ppu":
+			space = SpacePPU
+		case args[0] == "cpu":
+			space = SpaceCPU
+		case strings.Trim(args[0], "rwx") == "":
+			access = 0
+			for _, c := range args[0] {
+				switch c {
+				case 'r':
+					access |= AccessRead
+				case 'w':
+					access |= AccessWrite
+				case 'x':
+					access |= AccessExecute
+				}
+			}
+		default:
+			return fmt.Errorf("bad watch option %q", args[0])
+		}
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return errors.New("usage: w [rwx] [ppu] ADDR[-END] [if COND]")
+	}
+	if space == SpacePPU && access&AccessExecute != 0 {
+		return errors.New("the PPU does not execute code")
+	}
+	bounds := strings.SplitN(args[0], "-", 2)
+	start, err := r.d.Address(bounds[0])
+	if err != nil {
+		return err
+	}
+	end := start
+	if len(bounds) == 2 {
+		if end, err = r.d.Address(bounds[1]); err != nil {
+			return err
+		}
+	}
+	if end < start {
+		return fmt.Errorf("bad range $%04X-$%04X", start, end)
+	}
+	w := r.d.AddWatchpoint(space, start, end, access, cond)
+	fmt.Fprintf(r.out, "watchpoint %d: %s %s $%04X-$%04X\n", w.ID, w.Space, w.Access, w.Start, w.End)
+	return nil
+}
+
+func (r *debugREPL) stopped(stop Stop) {
+	if stop.Reason != "stepped" {
+		fmt.Fprintf(r.out, "stopped: %v\n", stop)
+	}
+	r.where()
+}
+
+// where shows the instruction about to run.
+func (r *debugREPL) where() {
+	if where := r.d.Where(r.d.nes.CPU.PC); where != "" {
+		fmt.Fprintf(r.out, "%s:\n", where)
+	}
+	fmt.Fprintln(r.out, TraceLine(r.d.nes.CPU))
+}
+
+func (r *debugREPL) regs() {
+	c := r.d.nes.CPU
+	p := r.d.nes.PPU
+	fmt.Fprintf(r.out, "PC:%04X A:%02X X:%02X Y:%02X S:%02X P:%02X\n", c.PC, c.A, c.X, c.Y, c.S, c.P)
+	fmt.Fprintf(r.out, "frame %d, scanline %d, dot %d, cycle %d\n", p.Frame, p.Line, p.Cycle, c.Cycle)
+}
+
+func (r *debugREPL) ram(args []string) error {
+	n := r.d.nes
+	if n.Watches == nil {
+		n.Watches = NewWatchList()
+	}
+	l := n.Watches
+	if len(args) == 0 {
+		l.Write(r.out)
+		return nil
+	}
+
+	if args[0] == "add" {
+		if len(args) != 2 {
+			return errors.New("usage: ram add [SPACE:]ADDR[:FMT[:NAME]]")
+		}
+		w, err := l.ParseWatch(args[1])
+		if err != nil {
+			return err
+		}
+		w.Value = w.read(n)
+		fmt.Fprintln(r.out, w)
+		return nil
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("usage: ram %s ID", args[0])
+	}
+	id, err := parseNumber(args[1])
+	if err != nil {
+		return err
+	}
+	w := l.Get(id)
+	if w == nil {
+		return fmt.Errorf("no watch %d", id)
+	}
+	switch args[0] {
+	case "del":
+		l.Remove(id)
+	case "freeze":
+		value := w.read(n)
+		if len(args) > 2 {
+			if value, err = parseNumber(args[2]); err != nil {
+				return err
+			}
+		}
+		l.Freeze(n, w, value)
+		fmt.Fprintln(r.out, w)
+	case "thaw":
+		w.Frozen = false
+		fmt.Fprintln(r.out, w)
+	default:
+		return fmt.Errorf("unknown ram command %q", args[0])
+	}
+	return nil
+}
+
+func (r *debugREPL) cheatSearch(args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	if args[0] == "new" {
+		format := WatchU8
+		if len(args) > 1 {
+			var ok bool
+			if format, ok = ParseWatchFormat(args[1]); !ok {
+				return fmt.Errorf("unknown format %q", args[1])
+			}
+		}
+		r.search = NewCheatSearch(r.d.nes, format)
+		fmt.Fprintf(r.out, "%d candidates\n", len(r.search.Candidates()))
+		return nil
+	}
+	if r.search == nil {
+		return errors.New(`no search; start one with "cs new"`)
+	}
+	s := r.search
+
+	switch cmd := args[0]; {
+	case cmd == "snap":
+		s.Snapshot()
+	case cmd == "list":
+		max := 20
+		if len(args) > 1 {
+			v, err := parseNumber(args[1])
+			if err != nil {
+				return err
+			}
+			max = v
+		}
+		s.Write(r.out, max)
+		return nil
+	case cmd == "keep":
+		if len(args) < 3 {
+			return errors.New("usage: cs keep I VALUE [NAME]")
+		}
+		i, err := parseNumber(args[1])
+		if err != nil {
+			return err
+		}
+		if i < 0 || i >= len(s.Candidates()) {
+			return fmt.Errorf("no candidate %d", i)
+		}
+		value, err := parseNumber(args[2])
+		if err != nil {
+			return err
+		}
+		w := s.Promote(s.Candidates()[i], value, strings.Join(args[3:], " "))
+		fmt.Fprintln(r.out, w)
+		fmt.Fprintf(r.out, "nes run -freeze '%s'\n", w.FreezeSpec())
+		return nil
+	case strings.HasPrefix(cmd, "+"), strings.HasPrefix(cmd, "-"):
+		delta, err := parseNumber(strings.TrimPrefix(cmd, "+"))
+		if err != nil {
+			return err
+		}
+		s.Filter(SearchChangedBy, delta, false)
+	default:
+		op, ok := ParseSearchOp(cmd)
+		if !ok {
+			return fmt.Errorf("unknown cs command %q", cmd)
+		}
+		if len(args) > 2 {
+			return errors.New("usage: cs OP [VALUE]")
+		}
+		value := 0
+		if len(args) == 2 {
+			v, err := parseNumber(args[1])
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+		s.Filter(op, value, len(args) == 2)
+	}
+	fmt.Fprintf(r.out, "%d candidates\n", len(s.Candidates()))
+	return nil
+}
+
+// disasm lists the last executed instructions and the ones following
+// PC, or count instructions from an address.
+func (r *debugREPL) disasm(args []string) error {
+	n := r.d.nes
+	dis := NewDisassembler(n.CPUBus.Peek)
+	dis.Symbols = r.d.Symbols
+	dis.PRGOffset = n.PRGOffset
+	show := func(addr uint16, marker string) uint16 {
+		inst := dis.Decode(addr)
+		if name, ok := dis.label(addr); ok {
+			fmt.Fprintf(r.out, "  %s:\n", name)
+		}
+		fmt.Fprintf(r.out, "%s %04X  %s\n", marker, addr, dis.Format(inst))
+		return addr + uint16(inst.Size())
+	}
+
+	count := 8
+	if len(args) > 1 {
+		v, err := parseNumber(args[1])
+		if err != nil {
+			return err
+		}
+		count = v
+	}
+	if len(args) > 0 {
+		addr, err := r.d.Address(args[0])
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			addr = show(addr, " ")
+		}
+		return nil
+	}
+
+	history := r.d.History()
+	if len(history) > count/2 {
+		history = history[len(history)-count/2:]
+	}
+	for _, addr := range history {
+		show(addr, " ")
+	}
+	addr := show(n.CPU.PC, ">")
+	for i := 1; i < count-len(history); i++ {
+		addr = show(addr, " ")
+	}
+	return nil
+}
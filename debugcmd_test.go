@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDebugREPLFrameCount(t *testing.T) {
+	n := testNES(t, testLoopINES())
+	n.PowerOn()
+	d := NewDebugger(n)
+	defer d.Detach()
+	r := &debugREPL{d: d, out: &bytes.Buffer{}}
+
+	start := n.PPU.Frame
+	if _, err := r.exec("frame 3"); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.PPU.Frame - start; got != 3 {
+		t.Errorf("frame 3 ran %d frames", got)
+	}
+
+	// a breakpoint ends the count early
+	d.AddBreakpoint(0x8000, nil)
+	start = n.PPU.Frame
+	if _, err := r.exec("frame 3"); err != nil {
+		t.Fatal(err)
+	}
+	if n.PPU.Frame != start || n.CPU.PC != 0x8000 {
+		t.Errorf("frame 3 ran past a breakpoint: frame +%d, PC $%04X", n.PPU.Frame-start, n.CPU.PC)
+	}
+}
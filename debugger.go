@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Space is an address space of the machine. The debugger can watch the
+// CPU and PPU spaces.
+type Space int
+
+const (
+	SpaceCPU Space = iota
+	SpacePPU
+	SpaceOAM
+	SpacePalette
+	SpacePRGRAM
+)
+
+var spaceNames = []string{"cpu", "ppu", "oam", "pal", "prgram"}
+
+func (s Space) String() string {
+	if int(s) < len(spaceNames) {
+		return spaceNames[s]
+	}
+	return fmt.Sprintf("Space(%d)", int(s))
+}
+
+// ParseSpace returns the space named s.
+func ParseSpace(s string) (Space, bool) {
+	for i, name := range spaceNames {
+		if s == name {
+			return Space(i), true
+		}
+	}
+	return 0, false
+}
+
+// Condition is a conjunction of comparisons on the machine state, like
+// "A == $10 && X > 3".
+type Condition struct {
+	terms []conditionTerm
+	text  string
+}
+
+type conditionTerm struct {
+	left, right string
+	op          string
+}
+
+var conditionOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// ParseCondition parses a condition. Operands are the registers A, X,
+// Y, S, P and PC, LINE, DOT and FRAME of the PPU, VALUE (the byte
+// accessed, for watchpoints) and numbers in decimal or $hex.
+func ParseCondition(s string) (*Condition, error) {
+	c := &Condition{text: strings.TrimSpace(s)}
+	for _, part := range strings.Split(s, "&&") {
+		part = strings.TrimSpace(part)
+		var term conditionTerm
+		for _, op := range conditionOps {
+			if i := strings.Index(part, op); i >= 0 {
+				term = conditionTerm{
+					left:  strings.ToUpper(strings.TrimSpace(part[:i])),
+					right: strings.ToUpper(strings.TrimSpace(part[i+len(op):])),
+					op:    op,
+				}
+				break
+			}
+		}
+		if term.op == "" {
+			return nil, fmt.Errorf("bad condition %q", part)
+		}
+		for _, operand := range []string{term.left, term.right} {
+			if _, err := conditionValue(nil, operand, 0); err != nil {
+				return nil, err
+			}
+		}
+		c.terms = append(c.terms, term)
+	}
+	return c, nil
+}
+
+func (c *Condition) String() string {
+	return c.text
+}
+
+// Eval reports whether the condition holds for n, with value being the
+// byte accessed by a watchpoint.
+func (c *Condition) Eval(n *NES, value byte) bool {
+	if c == nil {
+		return true
+	}
+	for _, term := range c.terms {
+		left, _ := conditionValue(n, term.left, value)
+		right, _ := conditionValue(n, term.right, value)
+		var ok bool
+		switch term.op {
+		case "==":
+			ok = left == right
+		case "!=":
+			ok = left != right
+		case "<":
+			ok = left < right
+		case "<=":
+			ok = left <= right
+		case ">":
+			ok = left > right
+		case ">=":
+			ok = left >= right
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// conditionValue evaluates an operand. With a nil n it only checks the
+// operand is valid.
+func conditionValue(n *NES, operand string, value byte) (int, error) {
+	if v, err := parseNumber(operand); err == nil {
+		return v, nil
+	}
+	switch operand {
+	case "A", "X", "Y", "S", "P", "PC", "LINE", "DOT", "FRAME", "VALUE":
+	default:
+		return 0, fmt.Errorf("unknown operand %q", operand)
+	}
+	if n == nil {
+		return 0, nil
+	}
+	c := n.CPU
+	switch operand {
+	case "A":
+		return int(c.A), nil
+	case "X":
+		return int(c.X), nil
+	case "Y":
+		return int(c.Y), nil
+	case "S":
+		return int(c.S), nil
+	case "P":
+		return int(c.P), nil
+	case "PC":
+		return int(c.PC), nil
+	case "LINE":
+		return n.PPU.Line, nil
+	case "DOT":
+		return n.PPU.Cycle, nil
+	case "FRAME":
+		return n.PPU.Frame, nil
+	}
+	return int(value), nil
+}
+
+// parseNumber parses a decimal number, or a hex one prefixed by $ or 0x.
+func parseNumber(s string) (int, error) {
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "$"):
+		s, base = s[1:], 16
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		s, base = s[2:], 16
+	}
+	v, err := strconv.ParseInt(s, base, 32)
+	return int(v), err
+}
+
+type Breakpoint struct {
+	ID        int
+	Addr      uint16
+	Condition *Condition
+}
+
+type Watchpoint struct {
+	ID         int
+	Space      Space
+	Start, End uint16
+	Access     Access
+	Condition  *Condition
+}
+
+func (w *Watchpoint) matches(space Space, addr uint16, access Access) bool {
+	return w.Space == space && w.Access&access != 0 && w.Start <= addr && addr <= w.End
+}
+
+// Stop tells why the debugger stopped running.
+type Stop struct {
+	Reason     string
+	Breakpoint *Breakpoint
+	Watchpoint *Watchpoint
+	Addr       uint16
+	Value      byte
+	Access     Access
+}
+
+// StopInterrupted is the Reason of a run stopped by Interrupt.
+const StopInterrupted = "interrupted"
+
+func (s Stop) String() string {
+	switch {
+	case s.Breakpoint != nil:
+		return fmt.Sprintf("breakpoint %d at $%04X", s.Breakpoint.ID, s.Addr)
+	case s.Watchpoint != nil:
+		return fmt.Sprintf("watchpoint %d: %s %s $%04X = $%02X", s.Watchpoint.ID, s.Watchpoint.Space, s.Access, s.Addr, s.Value)
+	}
+	return s.Reason
+}
+
+// Address resolves a symbol name or a hex address.
+func (d *Debugger) Address(s string) (uint16, error) {
+	if d.Symbols != nil {
+		if sym, ok := d.Symbols.Find(s); ok {
+			return sym.Addr, nil
+		}
+	}
+	return parseAddress(s)
+}
+
+// Where describes the symbol and source line of addr as currently
+// mapped, or returns "".
+func (d *Debugger) Where(addr uint16) string {
+	if d.Symbols == nil {
+		return ""
+	}
+	return describePC(d.Symbols, addr, d.nes.PRGOffset(addr))
+}
+
+// debugHistory is the number of executed instructions remembered.
+const debugHistory = 16
+
+// Debugger runs the machine an instruction at a time, stopping at
+// breakpoints and watchpoints.
+type Debugger struct {
+	nes *NES
+
+	breakpoints []*Breakpoint
+	watchpoints []*Watchpoint
+	nextID      int
+
+	// watch hits are only recorded while instructions run, so the
+	// debugger's own reads do not trigger them
+	running bool
+	hit     *Stop
+
+	history []uint16
+
+	// Symbols names addresses in the REPL and GDB server, if set.
+	Symbols *Symbols
+
+	interrupted int32
+}
+
+func NewDebugger(n *NES) *Debugger {
+	d := &Debugger{nes: n, nextID: 1}
+	if w, ok := n.CPUBus.(watchable); ok {
+		w.SetAccessHook(func(addr uint16, value byte, access Access) {
+			d.access(SpaceCPU, addr, value, access)
+		})
+	}
+	if w, ok := n.PPUBus.(watchable); ok {
+		w.SetAccessHook(func(addr uint16, value byte, access Access) {
+			d.access(SpacePPU, addr, value, access)
+		})
+	}
+	return d
+}
+
+// Detach removes the debugger's hooks from the buses.
+func (d *Debugger) Detach() {
+	if w, ok := d.nes.CPUBus.(watchable); ok {
+		w.SetAccessHook(nil)
+	}
+	if w, ok := d.nes.PPUBus.(watchable); ok {
+		w.SetAccessHook(nil)
+	}
+}
+
+func (d *Debugger) access(space Space, addr uint16, value byte, access Access) {
+	if !d.running || d.hit != nil {
+		return
+	}
+	for _, w := range d.watchpoints {
+		if w.matches(space, addr, access) && w.Condition.Eval(d.nes, value) {
+			d.hit = &Stop{Watchpoint: w, Addr: addr, Value: value, Access: access}
+			return
+		}
+	}
+}
+
+func (d *Debugger) AddBreakpoint(addr uint16, cond *Condition) *Breakpoint {
+	b := &Breakpoint{ID: d.nextID, Addr: addr, Condition: cond}
+	d.nextID++
+	d.breakpoints = append(d.breakpoints, b)
+	return b
+}
+
+func (d *Debugger) AddWatchpoint(space Space, start, end uint16, access Access, cond *Condition) *Watchpoint {
+	w := &Watchpoint{ID: d.nextID, Space: space, Start: start, End: end, Access: access, Condition: cond}
+	d.nextID++
+	d.watchpoints = append(d.watchpoints, w)
+	return w
+}
+
+// Delete removes the breakpoint or watchpoint with the given ID.
+func (d *Debugger) Delete(id int) error {
+	for i, b := range d.breakpoints {
+		if b.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	for i, w := range d.watchpoints {
+		if w.ID == id {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint or watchpoint %d", id)
+}
+
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return d.breakpoints
+}
+
+func (d *Debugger) Watchpoints() []*Watchpoint {
+	return d.watchpoints
+}
+
+// History returns the addresses of the most recently executed
+// instructions, oldest first.
+func (d *Debugger) History() []uint16 {
+	return d.history
+}
+
+// Interrupt stops a running Continue or Run* from another goroutine. If
+// nothing is running, the next run stops before its first instruction.
+func (d *Debugger) Interrupt() {
+	atomic.StoreInt32(&d.interrupted, 1)
+}
+
+// run executes instructions until done returns true after one of them,
+// a breakpoint is reached or a watchpoint triggers. Breakpoints at the
+// first instruction are ignored, so running again moves on.
+func (d *Debugger) run(done func(opcode byte) bool) Stop {
+	defer atomic.StoreInt32(&d.interrupted, 0)
+	n := d.nes
+	for first := true; ; first = false {
+		if !first {
+			if b := d.breakpointAt(n.CPU.PC); b != nil {
+				return Stop{Breakpoint: b, Addr: n.CPU.PC}
+			}
+			if w := d.executeWatchpointAt(n.CPU.PC); w != nil {
+				return Stop{Watchpoint: w, Addr: n.CPU.PC, Value: n.CPUBus.Peek(n.CPU.PC), Access: AccessExecute}
+			}
+		}
+		if atomic.LoadInt32(&d.interrupted) != 0 {
+			return Stop{Reason: StopInterrupted}
+		}
+
+		pc := n.CPU.PC
+		opcode := n.CPUBus.Peek(pc)
+		d.running = true
+		n.Tick()
+		d.running = false
+
+		d.history = append(d.history, pc)
+		if len(d.history) > debugHistory {
+			d.history = d.history[1:]
+		}
+
+		if d.hit != nil {
+			hit := *d.hit
+			d.hit = nil
+			return hit
+		}
+		if done(opcode) {
+			return Stop{Reason: "stepped"}
+		}
+	}
+}
+
+func (d *Debugger) breakpointAt(pc uint16) *Breakpoint {
+	for _, b := range d.breakpoints {
+		if b.Addr == pc && b.Condition.Eval(d.nes, 0) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (d *Debugger) executeWatchpointAt(pc uint16) *Watchpoint {
+	for _, w := range d.watchpoints {
+		if w.matches(SpaceCPU, pc, AccessExecute) && w.Condition.Eval(d.nes, d.nes.CPUBus.Peek(pc)) {
+			return w
+		}
+	}
+	return nil
+}
+
+// StepInto executes one instruction.
+func (d *Debugger) StepInto() Stop {
+	return d.run(func(byte) bool { return true })
+}
+
+// StepOver executes one instruction, running subroutines called by JSR
+// to their return.
+func (d *Debugger) StepOver() Stop {
+	c := d.nes.CPU
+	if instruction_names[c.bus.Peek(c.PC)] != "JSR" {
+		return d.StepInto()
+	}
+	ret := c.PC + 3
+	s := c.S
+	return d.run(func(byte) bool {
+		return c.PC == ret && c.S == s
+	})
+}
+
+// StepOut runs until the current subroutine or interrupt handler
+// returns, popping the stack above where it is now.
+func (d *Debugger) StepOut() Stop {
+	c := d.nes.CPU
+	s := c.S
+	return d.run(func(opcode byte) bool {
+		name := instruction_names[opcode]
+		return (name == "RTS" || name == "RTI") && c.S > s
+	})
+}
+
+// Continue runs until a breakpoint or watchpoint.
+func (d *Debugger) Continue() Stop {
+	return d.run(func(byte) bool { return false })
+}
+
+// RunToScanline runs until the PPU starts drawing line.
+func (d *Debugger) RunToScanline(line int) Stop {
+	p := d.nes.PPU
+	if line < 0 || line >= p.scanlines {
+		return Stop{Reason: fmt.Sprintf("scanline %d out of range", line)}
+	}
+	prev := p.Line
+	return d.run(func(byte) bool {
+		entered := p.Line == line && prev != line
+		prev = p.Line
+		return entered
+	}).orReason(fmt.Sprintf("scanline %d", line))
+}
+
+// RunFrame runs until the PPU finishes the current frame.
+func (d *Debugger) RunFrame() Stop {
+	frame := d.nes.PPU.Frame
+	return d.run(func(byte) bool {
+		return d.nes.PPU.Frame != frame
+	}).orReason(fmt.Sprintf("frame %d", frame+1))
+}
+
+func (s Stop) orReason(reason string) Stop {
+	if s.Reason == "stepped" {
+		s.Reason = reason
+	}
+	return s
+}
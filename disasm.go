@@ -0,0 +1,425 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Instruction is one decoded instruction.
+type Instruction struct {
+	Addr   uint16
+	Bytes  []byte
+	Opcode byte
+	Mode   int
+	// Operand is the raw operand: a byte, a word or a branch offset.
+	Operand uint16
+}
+
+// Size returns the length of the instruction in bytes. Opcodes the
+// assembler does not know are a single .byte.
+func (i Instruction) Size() int {
+	return len(i.Bytes)
+}
+
+// Valid reports whether ca65 can assemble the instruction in its default
+// 6502 mode.
+func (i Instruction) Valid() bool {
+	return instruction_sizes[i.Opcode] != 0 && !isUnofficial(i.Opcode) && len(i.Bytes) == instruction_sizes[i.Opcode]
+}
+
+// Target returns the address the instruction refers to, if any.
+func (i Instruction) Target() (uint16, bool) {
+	switch i.Mode {
+	case modeAbsolute, modeAbsoluteX, modeAbsoluteY, modeIndirect,
+		modeZeroPage, modeZeroPageX, modeZeroPageY,
+		modeIndexedIndirect, modeIndirectIndexed:
+		return i.Operand, true
+	case modeRelative:
+		return i.Addr + 2 + uint16(int8(i.Operand)), true
+	}
+	return 0, false
+}
+
+// IsJump reports whether the target of the instruction is code.
+func (i Instruction) IsJump() bool {
+	if i.Mode == modeRelative {
+		return true
+	}
+	name := instruction_names[i.Opcode]
+	return i.Mode == modeAbsolute && (name == "JMP" || name == "JSR")
+}
+
+// Disassembler turns memory into ca65 assembly.
+type Disassembler struct {
+	Read func(addr uint16) byte
+	// Labels names addresses; operands referring to them use the name.
+	Labels map[uint16]string
+	// Symbols names addresses not in Labels. PRGOffset tells which
+	// PRG-ROM byte is at an address, for symbols in banked ROM.
+	Symbols   *Symbols
+	PRGOffset func(addr uint16) int
+}
+
+// label returns the name of addr.
+func (d *Disassembler) label(addr uint16) (string, bool) {
+	if label, ok := d.Labels[addr]; ok {
+		return label, true
+	}
+	if d.Symbols == nil {
+		return "", false
+	}
+	offset := -1
+	if d.PRGOffset != nil {
+		offset = d.PRGOffset(addr)
+	}
+	if sym, ok := d.Symbols.Lookup(addr, offset); ok {
+		return sym.Name, true
+	}
+	return "", false
+}
+
+func NewDisassembler(read func(addr uint16) byte) *Disassembler {
+	return &Disassembler{
+		Read:   read,
+		Labels: map[uint16]string{},
+	}
+}
+
+// Decode decodes the instruction at addr.
+func (d *Disassembler) Decode(addr uint16) Instruction {
+	opcode := d.Read(addr)
+	inst := Instruction{
+		Addr:   addr,
+		Opcode: opcode,
+		Mode:   instruction_modes[opcode],
+		Bytes:  []byte{opcode},
+	}
+	size := instruction_sizes[opcode]
+	if size == 0 {
+		return inst
+	}
+	for i := 1; i < size; i++ {
+		inst.Bytes = append(inst.Bytes, d.Read(addr+uint16(i)))
+	}
+	switch size {
+	case 2:
+		inst.Operand = uint16(inst.Bytes[1])
+	case 3:
+		inst.Operand = uint16(inst.Bytes[1]) | uint16(inst.Bytes[2])<<8
+	}
+	return inst
+}
+
+// Format renders inst in ca65 syntax.
+func (d *Disassembler) Format(inst Instruction) string {
+	if !inst.Valid() {
+		raw := make([]string, len(inst.Bytes))
+		for i, b := range inst.Bytes {
+			raw[i] = fmt.Sprintf("$%02X", b)
+		}
+		return ".byte " + strings.Join(raw, ", ")
+	}
+	name := strings.ToLower(instruction_names[inst.Opcode])
+	target, _ := inst.Target()
+	word := func() string {
+		if label, ok := d.label(target); ok {
+			return label
+		}
+		return fmt.Sprintf("$%04X", target)
+	}
+	zp := func() string {
+		if label, ok := d.label(target); ok {
+			return label
+		}
+		return fmt.Sprintf("$%02X", target)
+	}
+
+	switch inst.Mode {
+	case modeImplied:
+		return name
+	case modeAccumulator:
+		return name + " a"
+	case modeImmediate:
+		return fmt.Sprintf("%s #$%02X", name, inst.Operand)
+	case modeZeroPage:
+		return fmt.Sprintf("%s %s", name, zp())
+	case modeZeroPageX:
+		return fmt.Sprintf("%s %s,x", name, zp())
+	case modeZeroPageY:
+		return fmt.Sprintf("%s %s,y", name, zp())
+	case modeAbsolute, modeAbsoluteX, modeAbsoluteY:
+		operand := word()
+		// ca65 would pick zero page addressing for these
+		if target < 0x100 {
+			operand = "a:" + operand
+		}
+		switch inst.Mode {
+		case modeAbsoluteX:
+			operand += ",x"
+		case modeAbsoluteY:
+			operand += ",y"
+		}
+		return fmt.Sprintf("%s %s", name, operand)
+	case modeIndirect:
+		return fmt.Sprintf("%s (%s)", name, word())
+	case modeIndexedIndirect:
+		return fmt.Sprintf("%s (%s,x)", name, zp())
+	case modeIndirectIndexed:
+		return fmt.Sprintf("%s (%s),y", name, zp())
+	case modeRelative:
+		return fmt.Sprintf("%s %s", name, word())
+	}
+	return name
+}
+
+// Range decodes the instructions from start through end.
+func (d *Disassembler) Range(start, end uint16) []Instruction {
+	var insts []Instruction
+	for addr := int(start); addr <= int(end); {
+		inst := d.Decode(uint16(addr))
+		// an instruction running past the end is left as data
+		if addr+inst.Size()-1 > int(end) {
+			inst.Bytes = inst.Bytes[:1]
+		}
+		insts = append(insts, inst)
+		addr += inst.Size()
+	}
+	return insts
+}
+
+// Write writes start through end as a ca65 source listing. Jump and
+// branch targets inside the range get L<addr> labels unless already
+// named, and names outside the range are defined as constants.
+func (d *Disassembler) Write(w io.Writer, start, end uint16) error {
+	insts := d.Range(start, end)
+
+	starts := map[uint16]bool{}
+	for _, inst := range insts {
+		starts[inst.Addr] = true
+	}
+
+	labels := map[uint16]string{}
+	for _, inst := range insts {
+		if name, ok := d.label(inst.Addr); ok {
+			labels[inst.Addr] = name
+		}
+	}
+	for _, inst := range insts {
+		target, ok := inst.Target()
+		if !ok || !inst.Valid() {
+			continue
+		}
+		if _, named := labels[target]; named {
+			continue
+		}
+		if name, ok := d.label(target); ok {
+			labels[target] = name
+		} else if inst.IsJump() && starts[target] {
+			labels[target] = fmt.Sprintf("L%04X", target)
+		}
+	}
+	saved := d.Labels
+	d.Labels = labels
+	defer func() { d.Labels = saved }()
+
+	// names that are referenced but not placed in the listing
+	var equates []uint16
+	for _, inst := range insts {
+		target, ok := inst.Target()
+		if !ok || !inst.Valid() {
+			continue
+		}
+		if _, named := labels[target]; named && !starts[target] {
+			equates = append(equates, target)
+		}
+	}
+	sort.Slice(equates, func(i, j int) bool { return equates[i] < equates[j] })
+
+	defined := map[uint16]bool{}
+	for _, addr := range equates {
+		if defined[addr] {
+			continue
+		}
+		defined[addr] = true
+		if _, err := fmt.Fprintf(w, "%s = $%04X\n", labels[addr], addr); err != nil {
+			return err
+		}
+	}
+	if len(equates) > 0 {
+		fmt.Fprintln(w)
+	}
+
+	if _, err := fmt.Fprintf(w, ".org $%04X\n\n", start); err != nil {
+		return err
+	}
+	for _, inst := range insts {
+		if name, ok := labels[inst.Addr]; ok {
+			if _, err := fmt.Fprintf(w, "%s:\n", name); err != nil {
+				return err
+			}
+		}
+		raw := make([]string, len(inst.Bytes))
+		for i, b := range inst.Bytes {
+			raw[i] = fmt.Sprintf("%02X", b)
+		}
+		comment := strings.Join(raw, " ")
+		if !inst.Valid() && instruction_sizes[inst.Opcode] != 0 {
+			comment += " " + traceName(inst.Opcode)
+		}
+		if d.Symbols != nil && d.PRGOffset != nil {
+			if line, ok := d.Symbols.Line(d.PRGOffset(inst.Addr)); ok {
+				comment += "  " + line.String()
+			}
+		}
+		if _, err := fmt.Fprintf(w, "\t%-24s; %04X  %s\n", d.Format(inst), inst.Addr, comment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BankReader returns a reader over one bank of prg placed at org.
+// Addresses outside the bank read as 0.
+func BankReader(prg []byte, bank, bankSize int, org uint16) func(uint16) byte {
+	base := bank * bankSize
+	return func(addr uint16) byte {
+		offset := int(addr) - int(org)
+		if offset < 0 || offset >= bankSize || base+offset >= len(prg) {
+			return 0
+		}
+		return prg[base+offset]
+	}
+}
+
+// disasmCommand disassembles a PRG bank, or an address range as mapped
+// at power on.
+func disasmCommand(args []string) error {
+	fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+	configFlags := NewConfigFlags(fs)
+	bank := fs.Int("bank", -1, "PRG bank to disassemble")
+	bankSize := fs.Int("banksize", 16, "PRG bank size in KB")
+	org := fs.String("org", "", "address the bank is mapped at (default: $C000 for the last bank, else $8000)")
+	start := fs.String("start", "8000", "first address of the range, when no bank is given")
+	end := fs.String("end", "FFFF", "last address of the range")
+	output := fs.String("o", "", "write the listing to this file (default: stdout)")
+	symbolFiles := fs.String("symbols", "", "comma-separated .dbg, .mlb or .nl files (default: found next to the ROM)")
+	files := parseInterspersed(fs, args)
+
+	if len(files) != 1 {
+		return errors.New("usage: nes disasm [flags] rom.nes [flags]")
+	}
+
+	config, err := configFlags.Config()
+	if err != nil {
+		return err
+	}
+	r, err := LoadROM(files[0], config)
+	if err != nil {
+		return err
+	}
+	symbols, err := LoadSymbolFiles(splitList(*symbolFiles), files[0])
+	if err != nil {
+		return err
+	}
+
+	var d *Disassembler
+	var first, last uint16
+	if *bank >= 0 {
+		size := *bankSize * 1024
+		if size <= 0 || size > 0x8000 {
+			return fmt.Errorf("bad bank size %dKB", *bankSize)
+		}
+		banks := (len(r.PRG) + size - 1) / size
+		if *bank >= banks {
+			return fmt.Errorf("bank %d out of range, the ROM has %d banks of %dKB", *bank, banks, *bankSize)
+		}
+		first = uint16(0x8000)
+		if *bank == banks-1 {
+			first = uint16(0x10000 - size)
+		}
+		if *org != "" {
+			if first, err = parseAddress(*org); err != nil {
+				return err
+			}
+		}
+		last = first + uint16(size-1)
+		d = NewDisassembler(BankReader(r.PRG, *bank, size, first))
+		base, org := *bank*size, first
+		d.PRGOffset = func(addr uint16) int {
+			if addr < org || int(addr-org) >= size {
+				return -1
+			}
+			return base + int(addr-org)
+		}
+	} else {
+		if first, err = parseAddress(*start); err != nil {
+			return err
+		}
+		if last, err = parseAddress(*end); err != nil {
+			return err
+		}
+		if first < 0x4020 || last < first {
+			return fmt.Errorf("range $%04X-$%04X is not cartridge space", first, last)
+		}
+		m := NewMMC(r.Header.MapperNum, r)
+		d = NewDisassembler(m.Peek)
+		d.PRGOffset = func(addr uint16) int {
+			return prgOffset(m, addr)
+		}
+	}
+	d.Symbols = symbols
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return d.Write(w, first, last)
+}
+
+// parseInterspersed parses flags before, between and after the
+// positional arguments, which it returns. Everything after -- is
+// positional.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// splitList splits a comma-separated flag value.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// parseAddress parses a hex address, with or without a $ or 0x prefix.
+func parseAddress(s string) (uint16, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(s), "$"), "0x")
+	v, err := strconv.ParseUint(s, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad address %q", s)
+	}
+	return uint16(v), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	tests := []struct {
+		args []string
+		bank int
+		want []string
+	}{
+		{[]string{"-bank", "3", "rom.nes"}, 3, []string{"rom.nes"}},
+		{[]string{"rom.nes", "-bank", "3"}, 3, []string{"rom.nes"}},
+		{[]string{"a.nes", "-bank", "2", "b.nes"}, 2, []string{"a.nes", "b.nes"}},
+		{[]string{"-bank", "1", "--", "-bank", "2"}, 1, []string{"-bank", "2"}},
+		{[]string{"rom.nes", "--", "-x"}, -1, []string{"rom.nes", "-x"}},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		bank := fs.Int("bank", -1, "")
+		got := parseInterspersed(fs, tt.args)
+		if *bank != tt.bank || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: bank %d, args %q; want %d, %q", tt.args, *bank, got, tt.bank, tt.want)
+		}
+	}
+}
+
+// memoryReader reads code placed at org, and 0 elsewhere.
+func memoryReader(org uint16, code []byte) func(uint16) byte {
+	return BankReader(code, 0, len(code), org)
+}
+
+func TestDisassemblerFormat(t *testing.T) {
+	tests := []struct {
+		code []byte
+		want string
+	}{
+		{[]byte{0xEA}, "nop"},
+		{[]byte{0x0A}, "asl a"},
+		{[]byte{0xA9, 0x10}, "lda #$10"},
+		{[]byte{0xA5, 0x10}, "lda $10"},
+		{[]byte{0xB5, 0x10}, "lda $10,x"},
+		{[]byte{0xB6, 0x10}, "ldx $10,y"},
+		{[]byte{0xAD, 0x34, 0x12}, "lda $1234"},
+		{[]byte{0xAD, 0x10, 0x00}, "lda a:$0010"},
+		{[]byte{0xBD, 0x34, 0x12}, "lda $1234,x"},
+		{[]byte{0xBD, 0x10, 0x00}, "lda a:$0010,x"},
+		{[]byte{0xB9, 0xFF, 0x00}, "lda a:$00FF,y"},
+		{[]byte{0x6C, 0x34, 0x12}, "jmp ($1234)"},
+		{[]byte{0xA1, 0x10}, "lda ($10,x)"},
+		{[]byte{0xB1, 0x10}, "lda ($10),y"},
+		{[]byte{0xD0, 0xFE}, "bne $8000"},
+		{[]byte{0x10, 0x10}, "bpl $8012"},
+		{[]byte{0x04, 0x10}, ".byte $04, $10"},
+		{[]byte{0x0C, 0x34, 0x12}, ".byte $0C, $34, $12"},
+		{[]byte{0x1A}, ".byte $1A"},
+		{[]byte{0xA7, 0x10}, ".byte $A7"},
+		{[]byte{0x02}, ".byte $02"},
+	}
+	for _, tt := range tests {
+		d := NewDisassembler(memoryReader(0x8000, tt.code))
+		inst := d.Decode(0x8000)
+		if got := d.Format(inst); got != tt.want {
+			t.Errorf("% X: got %q, want %q", tt.code, got, tt.want)
+		}
+	}
+
+	d := NewDisassembler(memoryReader(0x8000, []byte{0xAD, 0x34, 0x12, 0x85, 0x10}))
+	d.Labels[0x1234] = "data"
+	d.Labels[0x0010] = "ptr"
+	if got := d.Format(d.Decode(0x8000)); got != "lda data" {
+		t.Errorf("labelled absolute: got %q", got)
+	}
+	if got := d.Format(d.Decode(0x8003)); got != "sta ptr" {
+		t.Errorf("labelled zero page: got %q", got)
+	}
+}
+
+func TestDisassemblerWrite(t *testing.T) {
+	code := []byte{
+		0xA2, 0x00, // ldx #$00
+		0xE8,       // inx
+		0xD0, 0xFD, // bne $8002
+		0x4C, 0x00, 0x80, // jmp $8000
+		0x20, 0x00, 0xC0, // jsr $C000
+		0x04, 0x10, // nop $10 (unofficial)
+	}
+	d := NewDisassembler(memoryReader(0x8000, code))
+	d.Labels[0xC000] = "init"
+	var buf bytes.Buffer
+	if err := d.Write(&buf, 0x8000, 0x800C); err != nil {
+		t.Fatal(err)
+	}
+	line := func(asm string, addr uint16, comment string) string {
+		return fmt.Sprintf("\t%-24s; %04X  %s\n", asm, addr, comment)
+	}
+	want := "init = $C000\n\n.org $8000\n\nL8000:\n" +
+		line("ldx #$00", 0x8000, "A2 00") +
+		"L8002:\n" +
+		line("inx", 0x8002, "E8") +
+		line("bne L8002", 0x8003, "D0 FD") +
+		line("jmp L8000", 0x8005, "4C 00 80") +
+		line("jsr init", 0x8008, "20 00 C0") +
+		line(".byte $04, $10", 0x800B, "04 10 "+traceName(0x04))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
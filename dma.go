@@ -1,11 +1,23 @@
 package main
 
+// DMAStallCycles is how long the CPU is halted by an OAM DMA.
+const DMAStallCycles = 513
+
 type dma struct {
-	bus bus
+	bus   bus
+	stall int
 }
 
 func (d *dma) Transfer(addr uint16, target []byte) {
 	for i := uint16(0); int(i) < len(target); i++ {
 		target[i] = d.bus.Get(addr + i)
 	}
+	d.stall += DMAStallCycles
+}
+
+// Stall returns the CPU cycles taken by transfers since the last call.
+func (d *dma) Stall() int {
+	s := d.stall
+	d.stall = 0
+	return s
 }
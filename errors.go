@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownFormat is returned when an image does not start with a known
+// magic number.
+var ErrUnknownFormat = errors.New("unknown format")
+
+// TruncatedError is returned when an image ends before a section the
+// header announces.
+type TruncatedError struct {
+	Section string
+	Want    int
+	Got     int
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("truncated %s: want %d bytes, got %d", e.Section, e.Want, e.Got)
+}
+
+// SizeMismatchError is returned when an image is larger than its header
+// accounts for.
+type SizeMismatchError struct {
+	Want int
+	Got  int
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("size mismatch: header describes %d bytes, image has %d", e.Want, e.Got)
+}
+
+// HeaderError is returned when a header field holds an invalid or
+// unsupported value.
+type HeaderError struct {
+	Field  string
+	Reason string
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("unsupported header: %s: %s", e.Field, e.Reason)
+}
+
+// ArchiveError is returned when an archive holds no loadable image, or
+// more than one with none selected.
+type ArchiveError struct {
+	Archive    string
+	Candidates []string
+}
+
+func (e *ArchiveError) Error() string {
+	if len(e.Candidates) == 0 {
+		return fmt.Sprintf("%s: no loadable ROM entry (%s)", e.Archive, strings.Join(romExtensions, ", "))
+	}
+	return fmt.Sprintf("%s: multiple ROM entries (%s), select one with %s#<entry>",
+		e.Archive, strings.Join(e.Candidates, ", "), e.Archive)
+}
+
+// ChecksumError is returned when a CRC32 check of a patch, its source or
+// its result fails.
+type ChecksumError struct {
+	What string
+	Want uint32
+	Got  uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s CRC32 mismatch: want %08x, got %08x", e.What, e.Want, e.Got)
+}
+
+// StateVersionError is returned for a save state this version cannot
+// read: one with an invalid version, or one that needs a newer version
+// (Compat) to load.
+type StateVersionError struct {
+	Version uint32
+	Compat  uint32
+}
+
+func (e *StateVersionError) Error() string {
+	if e.Compat > 0 {
+		return fmt.Sprintf("save state version %d needs version %d to load, this is %d", e.Version, e.Compat, StateVersion)
+	}
+	return fmt.Sprintf("unknown save state version %d", e.Version)
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// MapperFDS is the mapper number NES 2.0 reserves for the Famicom Disk
+// System.
+const MapperFDS = 20
+
+const (
+	FDSMagic      = "FDS\x1A"
+	FDSHeaderSize = 16
+	FDSSideSize   = 65500
+	FDSBIOSSize   = 8 * 1024
+	FDSRAMSize    = 32 * 1024
+	FDSBIOSName   = "disksys.rom"
+)
+
+const (
+	FDSAddressRegisters = 0x4020
+	FDSAddressSound     = 0x4040
+	FDSAddressRAM       = 0x6000
+	FDSAddressBIOS      = 0xE000
+)
+
+const (
+	FDSAddressTimerLow  = 0x4020
+	FDSAddressTimerHigh = 0x4021
+	FDSAddressTimerCtrl = 0x4022
+	FDSAddressIOEnable  = 0x4023
+	FDSAddressWriteData = 0x4024
+	FDSAddressCtrl      = 0x4025
+	FDSAddressExtWrite  = 0x4026
+	FDSAddressStatus    = 0x4030
+	FDSAddressReadData  = 0x4031
+	FDSAddressDrive     = 0x4032
+	FDSAddressExtRead   = 0x4033
+)
+
+// disk drive timing, in CPU cycles
+const (
+	// the drive transfers 96.4 kbit/s, a byte every ~149 CPU cycles
+	fdsByteCycles = 149
+	// time for the head to return to the start of the disk
+	fdsRewindCycles = 50000
+	// time a disk stays out of the drive while switching sides
+	fdsSwapCycles = CPUFrequency
+)
+
+// gaps inserted between blocks when a side is laid out on the track
+const (
+	fdsLeadingGap = 28300 / 8
+	fdsBlockGap   = 976 / 8
+)
+
+// FDS block types
+const (
+	fdsBlockDiskInfo   = 1
+	fdsBlockFileAmount = 2
+	fdsBlockFileHeader = 3
+	fdsBlockFileData   = 4
+)
+
+var fdsDiskMagic = []byte("\x01*NINTENDO-HVC*")
+
+func isFDSImage(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(FDSMagic)) || bytes.HasPrefix(data, fdsDiskMagic)
+}
+
+// loadFDS parses an .fds image with or without the fwNES header.
+func (r *rom) loadFDS(data []byte) error {
+	if bytes.HasPrefix(data, []byte(FDSMagic)) {
+		if len(data) < FDSHeaderSize {
+			return &TruncatedError{"fwNES header", FDSHeaderSize, len(data)}
+		}
+		sides := int(data[4])
+		data = data[FDSHeaderSize:]
+		if len(data) < sides*FDSSideSize {
+			return &TruncatedError{"disk image", sides * FDSSideSize, len(data)}
+		}
+	}
+	if len(data) == 0 || len(data)%FDSSideSize != 0 {
+		return &SizeMismatchError{(len(data)/FDSSideSize + 1) * FDSSideSize, len(data)}
+	}
+
+	r.Disk = nil
+	for i := 0; i < len(data); i += FDSSideSize {
+		side := make([]byte, FDSSideSize)
+		copy(side, data[i:])
+		if !bytes.HasPrefix(side, fdsDiskMagic) {
+			return &HeaderError{"disk side", fmt.Sprintf("side %d has no disk info block", i/FDSSideSize)}
+		}
+		r.Disk = append(r.Disk, side)
+	}
+
+	r.Header = Header{
+		MapperNum:  MapperFDS,
+		Mirroring:  MirroringHorizontal,
+		PRGRAMSize: FDSRAMSize,
+		CHRRAMSize: DefaultCHRRAM,
+	}
+
+	log.Printf("FDS: %d sides\n", len(r.Disk))
+
+	r.allocateRAM()
+	return nil
+}
+
+// LoadFDSBIOS loads the disk system BIOS from file, or from disksys.rom
+// next to romFile when file is empty.
+func (r *rom) LoadFDSBIOS(file, romFile string) error {
+	if file == "" {
+		file = filepath.Join(filepath.Dir(romFile), FDSBIOSName)
+		if _, err := os.Stat(file); err != nil {
+			return errors.New("FDS images need the disk system BIOS (-fdsbios)")
+		}
+	}
+	bios, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(bios) != FDSBIOSSize {
+		return &SizeMismatchError{FDSBIOSSize, len(bios)}
+	}
+	r.PRG = bios
+	r.Header.PRGROMSize = len(bios)
+	return nil
+}
+
+// fdsBlockSize returns the size of the block at the start of p, given the
+// file size of the preceding file header block. It returns 0 at the end
+// of the data on a side.
+func fdsBlockSize(p []byte, fileSize int) int {
+	if len(p) == 0 {
+		return 0
+	}
+	switch p[0] {
+	case fdsBlockDiskInfo:
+		return 56
+	case fdsBlockFileAmount:
+		return 2
+	case fdsBlockFileHeader:
+		return 16
+	case fdsBlockFileData:
+		return 1 + fileSize
+	}
+	return 0
+}
+
+func fdsFileSize(header []byte) int {
+	return int(header[13]) | int(header[14])<<8
+}
+
+// fdsCRC updates the CRC-16 the drive computes over a block, its start
+// mark included.
+func fdsCRC(crc uint16, value byte) uint16 {
+	for n := uint(0); n < 8; n++ {
+		carry := crc & 1
+		crc >>= 1
+		if carry != 0 {
+			crc ^= 0x8408
+		}
+		if value&(1<<n) != 0 {
+			crc ^= 0x8000
+		}
+	}
+	return crc
+}
+
+// layoutTrack lays a side out as the drive sees it: blocks separated by
+// gaps, each starting with a $80 mark and followed by its CRC.
+func layoutTrack(side []byte) []byte {
+	track := make([]byte, fdsLeadingGap, FDSSideSize+FDSSideSize/4)
+	fileSize := 0
+	for pos := 0; pos < len(side); {
+		size := fdsBlockSize(side[pos:], fileSize)
+		if size == 0 || pos+size > len(side) {
+			break
+		}
+		block := side[pos : pos+size]
+		if block[0] == fdsBlockFileHeader {
+			fileSize = fdsFileSize(block)
+		}
+
+		crc := fdsCRC(0, 0x80)
+		for _, b := range block {
+			crc = fdsCRC(crc, b)
+		}
+		crc = fdsCRC(crc, 0)
+		crc = fdsCRC(crc, 0)
+		track = append(track, 0x80)
+		track = append(track, block...)
+		track = append(track, byte(crc), byte(crc>>8))
+		track = append(track, make([]byte, fdsBlockGap)...)
+		pos += size
+	}
+	if len(track) < cap(track) {
+		track = track[:cap(track)]
+	}
+	return track
+}
+
+// rebuildSide reads the blocks back from a track, dropping gaps, marks
+// and CRCs, to get the side in .fds format.
+func rebuildSide(track []byte) []byte {
+	side := make([]byte, 0, FDSSideSize)
+	fileSize := 0
+	pos := 0
+	for {
+		for pos < len(track) && track[pos] == 0 {
+			pos++
+		}
+		if pos >= len(track) || track[pos] != 0x80 {
+			break
+		}
+		pos++
+		size := fdsBlockSize(track[pos:], fileSize)
+		if size == 0 || pos+size > len(track) || len(side)+size > FDSSideSize {
+			break
+		}
+		block := track[pos : pos+size]
+		if block[0] == fdsBlockFileHeader {
+			fileSize = fdsFileSize(block)
+		}
+		side = append(side, block...)
+		pos += size + 2
+	}
+	return side[:FDSSideSize]
+}
+
+type fds struct {
+	rom *rom
+
+	tracks   [][]byte
+	side     int
+	inserted bool
+	// pending side to insert after a swap, or -1
+	swapSide  int
+	swapDelay int
+
+	diskIOEnabled  bool
+	soundIOEnabled bool
+
+	timerReload  uint16
+	timerCounter uint16
+	timerRepeat  bool
+	timerEnabled bool
+	timerIRQ     bool
+
+	motorOn       bool
+	resetTransfer bool
+	readMode      bool
+	mirroring     Mirroring
+	crcControl    bool
+	diskReady     bool
+	diskIRQEnable bool
+	diskIRQ       bool
+
+	position         int
+	delay            int
+	endOfHead        bool
+	scanning         bool
+	gapEnded         bool
+	transferComplete bool
+	previousCRC      bool
+	crc              uint16
+	readData         byte
+	writeData        byte
+	extData          byte
+}
+
+func NewFDS(rom *rom) mmc {
+	f := &fds{
+		rom:       rom,
+		inserted:  true,
+		swapSide:  -1,
+		mirroring: MirroringHorizontal,
+		endOfHead: true,
+	}
+	f.layoutTracks()
+	return f
+}
+
+func (f *fds) layoutTracks() {
+	f.tracks = make([][]byte, len(f.rom.Disk))
+	for i, side := range f.rom.Disk {
+		f.tracks[i] = layoutTrack(side)
+	}
+}
+
+func (f *fds) Get(address uint16) byte {
+	switch {
+	case address < MMC0AddressVRAM_Limit:
+		return f.rom.GetCHR(address)
+	case address < FDSAddressRegisters:
+		return 0
+	case address < FDSAddressSound:
+		return f.getRegister(address)
+	case address < FDSAddressRAM:
+		return 0
+	case address < FDSAddressBIOS:
+		return f.rom.GetPRGRAM(address - FDSAddressRAM)
+	}
+	return f.rom.GetPRG(address - FDSAddressBIOS)
+}
+
+func (f *fds) Peek(address uint16) byte {
+	if FDSAddressRegisters <= address && address < FDSAddressSound {
+		return f.peekRegister(address)
+	}
+	return f.Get(address)
+}
+
+func (f *fds) Set(address uint16, value byte) {
+	switch {
+	case address < MMC0AddressVRAM_Limit:
+		f.rom.SetCHR(address, value)
+	case address < FDSAddressRegisters:
+	case address < FDSAddressSound:
+		f.setRegister(address, value)
+	case address < FDSAddressRAM:
+	case address < FDSAddressBIOS:
+		f.rom.SetPRGRAM(address-FDSAddressRAM, value)
+	}
+}
+
+func (f *fds) getRegister(address uint16) byte {
+	v := f.peekRegister(address)
+	if !f.diskIOEnabled {
+		return v
+	}
+	switch address {
+	case FDSAddressStatus:
+		f.transferComplete = false
+		f.timerIRQ = false
+		f.diskIRQ = false
+	case FDSAddressReadData:
+		f.transferComplete = false
+		f.diskIRQ = false
+	}
+	return v
+}
+
+// peekRegister returns the value of a register, leaving the flags that
+// reading it acknowledges alone.
+func (f *fds) peekRegister(address uint16) byte {
+	if !f.diskIOEnabled {
+		return 0
+	}
+	switch address {
+	case FDSAddressStatus:
+		var v byte
+		if f.timerIRQ {
+			v |= 0x01
+		}
+		if f.transferComplete {
+			v |= 0x02
+		}
+		if f.crc != 0 {
+			v |= 0x10
+		}
+		if f.endOfHead {
+			v |= 0x40
+		}
+		return v
+	case FDSAddressReadData:
+		return f.readData
+	case FDSAddressDrive:
+		var v byte
+		if !f.inserted {
+			v |= 0x01 | 0x04
+		}
+		if !f.inserted || !f.scanning {
+			v |= 0x02
+		}
+		return v
+	case FDSAddressExtRead:
+		// battery is good
+		return 0x80 | f.extData&0x7F
+	}
+	return 0
+}
+
+func (f *fds) setRegister(address uint16, value byte) {
+	if !f.diskIOEnabled && address != FDSAddressIOEnable && address < FDSAddressCtrl {
+		return
+	}
+	switch address {
+	case FDSAddressTimerLow:
+		f.timerReload = f.timerReload&0xFF00 | uint16(value)
+	case FDSAddressTimerHigh:
+		f.timerReload = f.timerReload&0x00FF | uint16(value)<<8
+	case FDSAddressTimerCtrl:
+		f.timerRepeat = value&0x01 != 0
+		f.timerEnabled = value&0x02 != 0 && f.diskIOEnabled
+		if f.timerEnabled {
+			f.timerCounter = f.timerReload
+		} else {
+			f.timerIRQ = false
+		}
+	case FDSAddressIOEnable:
+		f.diskIOEnabled = value&0x01 != 0
+		f.soundIOEnabled = value&0x02 != 0
+		if !f.diskIOEnabled {
+			f.timerEnabled = false
+			f.timerIRQ = false
+			f.diskIRQ = false
+		}
+	case FDSAddressWriteData:
+		f.writeData = value
+		f.transferComplete = false
+		f.diskIRQ = false
+	case FDSAddressCtrl:
+		f.motorOn = value&0x01 != 0
+		f.resetTransfer = value&0x02 != 0
+		f.readMode = value&0x04 != 0
+		if value&0x08 != 0 {
+			f.mirroring = MirroringHorizontal
+		} else {
+			f.mirroring = MirroringVertical
+		}
+		f.crcControl = value&0x10 != 0
+		f.diskReady = value&0x40 != 0
+		f.diskIRQEnable = value&0x80 != 0
+		f.diskIRQ = false
+	case FDSAddressExtWrite:
+		f.extData = value
+	}
+}
+
+func (f *fds) Mirroring() Mirroring {
+	return f.mirroring
+}
+
+func (f *fds) IRQ() bool {
+	return f.timerIRQ || f.diskIRQ
+}
+
+// Clock advances the timer and the disk drive by one CPU cycle.
+func (f *fds) Clock() {
+	if f.timerEnabled && f.diskIOEnabled {
+		if f.timerCounter == 0 {
+			f.timerIRQ = true
+			f.timerCounter = f.timerReload
+			if !f.timerRepeat {
+				f.timerEnabled = false
+			}
+		} else {
+			f.timerCounter--
+		}
+	}
+
+	if f.swapSide >= 0 {
+		f.swapDelay--
+		if f.swapDelay <= 0 {
+			f.side = f.swapSide
+			f.swapSide = -1
+			f.inserted = true
+			log.Printf("FDS: side %d inserted\n", f.side)
+		}
+	}
+
+	f.clockDrive()
+}
+
+func (f *fds) clockDrive() {
+	if !f.inserted || !f.motorOn {
+		f.endOfHead = true
+		f.scanning = false
+		return
+	}
+	if f.resetTransfer && !f.scanning {
+		return
+	}
+	if f.endOfHead {
+		f.delay = fdsRewindCycles
+		f.endOfHead = false
+		f.position = 0
+		f.gapEnded = false
+		return
+	}
+	if f.delay > 0 {
+		f.delay--
+		return
+	}
+
+	f.scanning = true
+	track := f.tracks[f.side]
+	needIRQ := f.diskIRQEnable
+
+	if f.readMode {
+		data := track[f.position]
+		if !f.previousCRC {
+			f.crc = fdsCRC(f.crc, data)
+		}
+		if !f.diskReady {
+			f.gapEnded = false
+			f.crc = 0
+		} else if data != 0 && !f.gapEnded {
+			// the start mark ends the gap without a transfer
+			f.gapEnded = true
+			f.crc = fdsCRC(0, data)
+			needIRQ = false
+		} else if f.gapEnded {
+			f.transferComplete = true
+			f.readData = data
+			if needIRQ {
+				f.diskIRQ = true
+			}
+		}
+	} else {
+		var data byte
+		if !f.crcControl {
+			f.transferComplete = true
+			data = f.writeData
+			if needIRQ {
+				f.diskIRQ = true
+			}
+		}
+		if !f.diskReady {
+			data = 0
+			f.crc = 0
+		}
+		if !f.crcControl {
+			f.crc = fdsCRC(f.crc, data)
+		} else {
+			if !f.previousCRC {
+				// flush the CRC register before shifting it out
+				f.crc = fdsCRC(f.crc, 0)
+				f.crc = fdsCRC(f.crc, 0)
+			}
+			data = byte(f.crc)
+			f.crc >>= 8
+		}
+		track[f.position] = data
+		f.gapEnded = false
+	}
+
+	f.previousCRC = f.crcControl
+	f.position++
+	if f.position >= len(track) {
+		f.motorOn = false
+		f.endOfHead = true
+		if needIRQ {
+			f.diskIRQ = true
+		}
+	} else {
+		f.delay = fdsByteCycles
+	}
+}
+
+// SwitchSide ejects the disk and inserts its next side a moment later,
+// like a player flipping the disk.
+func (f *fds) SwitchSide() {
+	if len(f.tracks) == 0 || f.swapSide >= 0 {
+		return
+	}
+	f.inserted = false
+	f.swapSide = (f.side + 1) % len(f.tracks)
+	f.swapDelay = fdsSwapCycles
+	log.Println("FDS: disk ejected")
+}
+
+// image returns the current contents of every side in .fds format.
+func (f *fds) image() []byte {
+	res := make([]byte, 0, len(f.tracks)*FDSSideSize)
+	for _, track := range f.tracks {
+		res = append(res, rebuildSide(track)...)
+	}
+	return res
+}
+
+// SaveData returns the changes made to the disk as an IPS patch against
+// the original image, which is never modified.
+func (f *fds) SaveData() []byte {
+	orig := bytes.Join(f.rom.Disk, nil)
+	return MakeIPS(orig, f.image())
+}
+
+// LoadSaveData applies changes saved by SaveData.
+func (f *fds) LoadSaveData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	img, err := applyIPS(data, bytes.Join(f.rom.Disk, nil))
+	if err != nil {
+		return err
+	}
+	if len(img) != len(f.tracks)*FDSSideSize {
+		return &SizeMismatchError{len(f.tracks) * FDSSideSize, len(img)}
+	}
+	for i := range f.tracks {
+		f.tracks[i] = layoutTrack(img[i*FDSSideSize : (i+1)*FDSSideSize])
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestFDSLoadSaveDataSize(t *testing.T) {
+	r := &rom{Disk: [][]byte{make([]byte, FDSSideSize), make([]byte, FDSSideSize)}}
+	f := NewFDS(r).(*fds)
+	orig := make([]byte, 2*FDSSideSize)
+
+	// truncated to a single side
+	size := FDSSideSize
+	short := append([]byte("PATCHEOF"), byte(size>>16), byte(size>>8), byte(size))
+	// grown by a byte
+	long := MakeIPS(orig, append(append([]byte{}, orig...), 1))
+
+	for name, patch := range map[string][]byte{"short": short, "long": long} {
+		err := f.LoadSaveData(patch)
+		if _, ok := err.(*SizeMismatchError); !ok {
+			t.Errorf("%s: got %v, want a SizeMismatchError", name, err)
+		}
+	}
+
+	if err := f.LoadSaveData(MakeIPS(orig, orig)); err != nil {
+		t.Errorf("unchanged image: %v", err)
+	}
+}
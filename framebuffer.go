@@ -0,0 +1,98 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sync"
+)
+
+func newFrameImage() *image.RGBA {
+	return image.NewRGBA(image.Rect(0, 0, PPUVisibleWidth, PPUVisibleHeight))
+}
+
+// TripleBuffer is a Renderer that hands completed frames from the
+// emulation goroutine to the display. The emulator draws into the back
+// buffer and publishes it on Render; the display takes the latest
+// published frame, so neither side ever waits for the other.
+type TripleBuffer struct {
+	mu    sync.Mutex
+	back  *image.RGBA
+	ready *image.RGBA
+	front *image.RGBA
+	fresh bool
+
+	notify chan struct{}
+}
+
+func NewTripleBuffer() *TripleBuffer {
+	return &TripleBuffer{
+		back:   newFrameImage(),
+		ready:  newFrameImage(),
+		front:  newFrameImage(),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// SetPixel draws into the back buffer. It must only be called from the
+// emulation goroutine.
+func (t *TripleBuffer) SetPixel(x, y int, col color.RGBA) {
+	t.back.SetRGBA(x, y, col)
+}
+
+// Render publishes the back buffer as the latest frame.
+func (t *TripleBuffer) Render() {
+	t.mu.Lock()
+	t.back, t.ready = t.ready, t.back
+	t.fresh = true
+	t.mu.Unlock()
+
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Frame returns the latest published frame, and whether it is new since
+// the last call. The image stays valid until the next call.
+func (t *TripleBuffer) Frame() (*image.RGBA, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fresh := t.fresh
+	if fresh {
+		t.front, t.ready = t.ready, t.front
+		t.fresh = false
+	}
+	return t.front, fresh
+}
+
+// Ready receives after a frame is published.
+func (t *TripleBuffer) Ready() <-chan struct{} {
+	return t.notify
+}
+
+// FrameBuffer is a Renderer that keeps frames in memory, for running
+// without a display.
+type FrameBuffer struct {
+	back  *image.RGBA
+	front *image.RGBA
+}
+
+func NewFrameBuffer() *FrameBuffer {
+	return &FrameBuffer{
+		back:  newFrameImage(),
+		front: newFrameImage(),
+	}
+}
+
+func (f *FrameBuffer) SetPixel(x, y int, col color.RGBA) {
+	f.back.SetRGBA(x, y, col)
+}
+
+func (f *FrameBuffer) Render() {
+	f.back, f.front = f.front, f.back
+}
+
+// Image returns the last completed frame.
+func (f *FrameBuffer) Image() *image.RGBA {
+	return f.front
+}
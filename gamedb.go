@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GameInfo is a game database entry, keyed by the CRC32 of PRG-ROM and
+// CHR-ROM combined.
+type GameInfo struct {
+	CRC32     uint32
+	MapperNum int
+	SubMapper int
+	Mirroring Mirroring
+	// MapperMirroring is set when the mapper switches mirroring, so
+	// Mirroring does not apply.
+	MapperMirroring bool
+	Battery         bool
+	Timing          Timing
+	PRGRAMSize      int
+	PRGNVRAMSize    int
+	CHRRAMSize      int
+	CHRNVRAMSize    int
+	ExpansionDevice int
+	Title           string
+}
+
+type DBPolicy int
+
+const (
+	// DBPolicyWarn keeps the header but logs discrepancies.
+	DBPolicyWarn DBPolicy = iota
+	// DBPolicyHeader trusts the header and skips the database.
+	DBPolicyHeader
+	// DBPolicyDatabase replaces header fields with the database entry.
+	DBPolicyDatabase
+)
+
+func ParseDBPolicy(s string) (DBPolicy, error) {
+	switch s {
+	case "warn", "":
+		return DBPolicyWarn, nil
+	case "header":
+		return DBPolicyHeader, nil
+	case "database":
+		return DBPolicyDatabase, nil
+	}
+	return 0, fmt.Errorf("unknown database policy: %q (want header, database or warn)", s)
+}
+
+func (p DBPolicy) String() string {
+	switch p {
+	case DBPolicyWarn:
+		return "warn"
+	case DBPolicyHeader:
+		return "header"
+	case DBPolicyDatabase:
+		return "database"
+	}
+	return fmt.Sprintf("DBPolicy(%d)", int(p))
+}
+
+var gameDB map[uint32]GameInfo
+
+func loadBuiltinGameDB() {
+	if gameDB != nil {
+		return
+	}
+	gameDB = map[uint32]GameInfo{}
+	if err := LoadGameDB(strings.NewReader(gameDBData)); err != nil {
+		panic(err)
+	}
+}
+
+// LoadGameDB adds the entries in rd to the game database, replacing
+// built-in entries with the same hash.
+//
+// Each line holds, separated by whitespace:
+//
+//	crc32 mapper submapper mirroring battery timing prgram prgnvram chrram chrnvram expansion title
+//
+// mirroring is H, V, 4 or M when the mapper controls it, timing is NTSC, PAL, multi or Dendy, and the
+// RAM sizes are in bytes. Empty lines and lines starting with # are
+// ignored.
+func LoadGameDB(rd io.Reader) error {
+	if gameDB == nil {
+		loadBuiltinGameDB()
+	}
+	s := bufio.NewScanner(rd)
+	line := 0
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		g, err := parseGameInfo(text)
+		if err != nil {
+			return fmt.Errorf("game database line %d: %v", line, err)
+		}
+		gameDB[g.CRC32] = g
+	}
+	return s.Err()
+}
+
+func parseGameInfo(text string) (GameInfo, error) {
+	var g GameInfo
+	f := strings.Fields(text)
+	if len(f) < 12 {
+		return g, fmt.Errorf("want 12 fields, got %d", len(f))
+	}
+
+	crc, err := strconv.ParseUint(f[0], 16, 32)
+	if err != nil {
+		return g, err
+	}
+	g.CRC32 = uint32(crc)
+
+	ints := []*int{&g.MapperNum, &g.SubMapper}
+	for i, p := range ints {
+		if *p, err = strconv.Atoi(f[1+i]); err != nil {
+			return g, err
+		}
+	}
+
+	switch f[3] {
+	case "H":
+		g.Mirroring = MirroringHorizontal
+	case "V":
+		g.Mirroring = MirroringVertical
+	case "4":
+		g.Mirroring = MirroringFourScreen
+	case "M":
+		g.MapperMirroring = true
+	default:
+		return g, fmt.Errorf("unknown mirroring: %q", f[3])
+	}
+
+	g.Battery = f[4] == "1"
+
+	switch f[5] {
+	case "NTSC":
+		g.Timing = TimingNTSC
+	case "PAL":
+		g.Timing = TimingPAL
+	case "multi":
+		g.Timing = TimingMulti
+	case "Dendy":
+		g.Timing = TimingDendy
+	default:
+		return g, fmt.Errorf("unknown timing: %q", f[5])
+	}
+
+	ints = []*int{&g.PRGRAMSize, &g.PRGNVRAMSize, &g.CHRRAMSize, &g.CHRNVRAMSize, &g.ExpansionDevice}
+	for i, p := range ints {
+		if *p, err = strconv.Atoi(f[6+i]); err != nil {
+			return g, err
+		}
+	}
+
+	g.Title = strings.Join(f[11:], " ")
+	return g, nil
+}
+
+// LoadGameDBFile adds the entries in file to the game database: the NES
+// 2.0 database when the name ends in .xml, else the format read by
+// LoadGameDB.
+func LoadGameDBFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(file), ".xml") {
+		err = LoadNES20DB(f)
+	} else {
+		err = LoadGameDB(f)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+// DefaultGameDBFile is where a copy of the NES 2.0 database is picked up
+// from when no -gamedb file is given.
+func DefaultGameDBFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "nes", "nes20db.xml")
+}
+
+type nes20Size struct {
+	Size  int    `xml:"size,attr"`
+	CRC32 string `xml:"crc32,attr"`
+}
+
+type nes20Game struct {
+	ROM       nes20Size  `xml:"rom"`
+	Trainer   *nes20Size `xml:"trainer"`
+	MiscROM   *nes20Size `xml:"miscrom"`
+	PRGRAM    nes20Size  `xml:"prgram"`
+	PRGNVRAM  nes20Size  `xml:"prgnvram"`
+	CHRRAM    nes20Size  `xml:"chrram"`
+	CHRNVRAM  nes20Size  `xml:"chrnvram"`
+	Expansion struct {
+		Type int `xml:"type,attr"`
+	} `xml:"expansion"`
+	Console struct {
+		Region int `xml:"region,attr"`
+	} `xml:"console"`
+	PCB struct {
+		Mapper    int    `xml:"mapper,attr"`
+		SubMapper int    `xml:"submapper,attr"`
+		Mirroring string `xml:"mirroring,attr"`
+		Battery   int    `xml:"battery,attr"`
+	} `xml:"pcb"`
+}
+
+// LoadNES20DB adds the games in an NES 2.0 database (nes20db.xml) to the
+// game database. Titles come from the comment holding the file name that
+// precedes each game. Games with a trainer or misc ROM are skipped, as
+// their checksum covers more than PRG-ROM and CHR-ROM.
+func LoadNES20DB(rd io.Reader) error {
+	loadBuiltinGameDB()
+	d := xml.NewDecoder(rd)
+	title := ""
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.Comment:
+			name := strings.Replace(strings.TrimSpace(string(t)), `\`, "/", -1)
+			title = strings.TrimSuffix(path.Base(name), path.Ext(name))
+		case xml.StartElement:
+			if t.Name.Local != "game" {
+				continue
+			}
+			var g nes20Game
+			if err := d.DecodeElement(&g, &t); err != nil {
+				return err
+			}
+			if info, ok := g.info(title); ok {
+				gameDB[info.CRC32] = info
+			}
+			title = ""
+		}
+	}
+}
+
+func (g *nes20Game) info(title string) (GameInfo, bool) {
+	info := GameInfo{
+		MapperNum:       g.PCB.Mapper,
+		SubMapper:       g.PCB.SubMapper,
+		Battery:         g.PCB.Battery != 0,
+		PRGRAMSize:      g.PRGRAM.Size,
+		PRGNVRAMSize:    g.PRGNVRAM.Size,
+		CHRRAMSize:      g.CHRRAM.Size,
+		CHRNVRAMSize:    g.CHRNVRAM.Size,
+		ExpansionDevice: g.Expansion.Type,
+		Title:           title,
+	}
+	if g.Trainer != nil || g.MiscROM != nil {
+		return info, false
+	}
+	crc, err := strconv.ParseUint(g.ROM.CRC32, 16, 32)
+	if err != nil {
+		return info, false
+	}
+	info.CRC32 = uint32(crc)
+
+	switch g.PCB.Mirroring {
+	case "H":
+		info.Mirroring = MirroringHorizontal
+	case "V":
+		info.Mirroring = MirroringVertical
+	case "4":
+		info.Mirroring = MirroringFourScreen
+	case "1":
+		info.MapperMirroring = true
+	default:
+		return info, false
+	}
+
+	timings := []Timing{TimingNTSC, TimingPAL, TimingMulti, TimingDendy}
+	if g.Console.Region < 0 || g.Console.Region >= len(timings) {
+		return info, false
+	}
+	info.Timing = timings[g.Console.Region]
+	return info, true
+}
+
+// LookupGame finds the database entry for a PRG+CHR CRC32.
+func LookupGame(crc uint32) (GameInfo, bool) {
+	loadBuiltinGameDB()
+	g, ok := gameDB[crc]
+	return g, ok
+}
+
+// Diff lists the header fields that disagree with the database entry.
+func (g GameInfo) Diff(h Header) []string {
+	var res []string
+	check := func(name string, header, db interface{}) {
+		if header != db {
+			res = append(res, fmt.Sprintf("%s: header %v, database %v", name, header, db))
+		}
+	}
+	check("mapper", h.MapperNum, g.MapperNum)
+	check("submapper", h.SubMapper, g.SubMapper)
+	if !g.MapperMirroring {
+		check("mirroring", h.Mirroring, g.Mirroring)
+	}
+	check("battery", h.Battery, g.Battery)
+	check("timing", h.Timing, g.Timing)
+	check("PRG-RAM", h.PRGRAMSize, g.PRGRAMSize)
+	check("PRG-NVRAM", h.PRGNVRAMSize, g.PRGNVRAMSize)
+	if h.CHRROMSize == 0 {
+		check("CHR-RAM", h.CHRRAMSize, g.CHRRAMSize)
+		check("CHR-NVRAM", h.CHRNVRAMSize, g.CHRNVRAMSize)
+	}
+	check("expansion device", h.ExpansionDevice, g.ExpansionDevice)
+	return res
+}
+
+// Apply overwrites the header fields the database knows about.
+func (g GameInfo) Apply(h *Header) {
+	h.MapperNum = g.MapperNum
+	h.SubMapper = g.SubMapper
+	if !g.MapperMirroring {
+		h.Mirroring = g.Mirroring
+	}
+	h.Battery = g.Battery
+	h.Timing = g.Timing
+	h.PRGRAMSize = g.PRGRAMSize
+	h.PRGNVRAMSize = g.PRGNVRAMSize
+	if h.CHRROMSize == 0 {
+		h.CHRRAMSize = g.CHRRAMSize
+		h.CHRNVRAMSize = g.CHRNVRAMSize
+	}
+	h.ExpansionDevice = g.ExpansionDevice
+}
+
+// checkGameDB consults the game database according to policy, correcting
+// the header and reallocating RAM when the database wins.
+func (r *rom) checkGameDB(policy DBPolicy) {
+	if policy == DBPolicyHeader {
+		return
+	}
+	g, ok := LookupGame(r.CRC32())
+	if !ok {
+		return
+	}
+	diff := g.Diff(r.Header)
+	if len(diff) == 0 {
+		return
+	}
+	for _, d := range diff {
+		log.Printf("%s: %s\n", g.Title, d)
+	}
+	if policy == DBPolicyDatabase {
+		log.Println("using game database entry")
+		g.Apply(&r.Header)
+		r.allocateRAM()
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+// gameDBData is the built-in game database, in the format read by
+// LoadGameDB. Entries are keyed by the CRC32 of PRG-ROM and CHR-ROM
+// without the header. The full NES 2.0 database is not bundled; it is
+// read from nes20db.xml when present (see DefaultGameDBFile and the
+// -gamedb flag).
+const gameDBData = `
+# crc32  mapper sub mirr batt timing prgram prgnvram chrram chrnvram exp title
+3337EC46 0 0 V 0 NTSC 0 0 0 0 1 Super Mario Bros. (World)
+`
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testINES builds an iNES image with the given PRG and CHR bank counts,
+// filling the banks with a pattern so the checksum is distinct.
+func testINES(prgBanks, chrBanks int, flags6 byte) []byte {
+	data := []byte{'N', 'E', 'S', 0x1A, byte(prgBanks), byte(chrBanks), flags6, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	size := prgBanks*16*1024 + chrBanks*8*1024
+	for i := 0; i < size; i++ {
+		data = append(data, byte(i*7+i>>8))
+	}
+	return data
+}
+
+func TestBuiltinGameDB(t *testing.T) {
+	g, ok := LookupGame(0x3337EC46)
+	if !ok {
+		t.Fatal("Super Mario Bros. is missing from the built-in database")
+	}
+	if g.MapperNum != 0 || g.Mirroring != MirroringVertical || g.Timing != TimingNTSC {
+		t.Errorf("unexpected entry: %+v", g)
+	}
+}
+
+func TestGameDBCorrectsHeader(t *testing.T) {
+	var r rom
+	// horizontal mirroring, no battery
+	if err := r.LoadBytes(testINES(1, 1, 0x00)); err != nil {
+		t.Fatal(err)
+	}
+	line := fmt.Sprintf("%08X 0 0 V 1 NTSC 0 8192 0 0 1 Bad Header Test", r.CRC32())
+	if err := LoadGameDB(strings.NewReader(line)); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(gameDB, r.CRC32())
+
+	r.checkGameDB(DBPolicyWarn)
+	if r.Header.Mirroring != MirroringHorizontal || r.Header.Battery {
+		t.Fatalf("warn policy changed the header: %+v", r.Header)
+	}
+
+	r.checkGameDB(DBPolicyDatabase)
+	if r.Header.Mirroring != MirroringVertical {
+		t.Errorf("mirroring = %v, want %v", r.Header.Mirroring, MirroringVertical)
+	}
+	if !r.Header.Battery {
+		t.Error("battery was not set")
+	}
+	if len(r.PRGRAM) != 8192 {
+		t.Errorf("PRG-RAM is %d bytes, want 8192", len(r.PRGRAM))
+	}
+}
+
+func TestParseGameInfoMapperMirroring(t *testing.T) {
+	g, err := parseGameInfo("12345678 1 0 M 1 PAL 0 8192 8192 0 1 Some Game")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.MapperMirroring || g.Title != "Some Game" {
+		t.Errorf("unexpected entry: %+v", g)
+	}
+	h := Header{MapperNum: 1, Mirroring: MirroringHorizontal, Battery: true, Timing: TimingPAL,
+		PRGNVRAMSize: 8192, CHRRAMSize: 8192, ExpansionDevice: 1}
+	if diff := g.Diff(h); len(diff) != 0 {
+		t.Errorf("mapper-controlled mirroring reported: %v", diff)
+	}
+}
+
+const testNES20DB = `<?xml version="1.0" encoding="UTF-8"?>
+<nes20db date="2024-01-01">
+	<!-- \Licensed\Some MMC1 Game (USA).nes -->
+	<game>
+		<prgrom size="131072" crc32="11111111"/>
+		<chrram size="8192"/>
+		<rom size="131072" crc32="1234ABCD"/>
+		<prgnvram size="8192"/>
+		<console type="0" region="1"/>
+		<expansion type="1"/>
+		<pcb mapper="1" submapper="0" mirroring="1" battery="1"/>
+	</game>
+	<!-- \Licensed\Trainer Game (USA).nes -->
+	<game>
+		<trainer size="512" crc32="22222222"/>
+		<rom size="40960" crc32="2345BCDE"/>
+		<console type="0" region="0"/>
+		<pcb mapper="0" submapper="0" mirroring="H" battery="0"/>
+	</game>
+</nes20db>`
+
+func TestLoadNES20DB(t *testing.T) {
+	if err := LoadNES20DB(strings.NewReader(testNES20DB)); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(gameDB, 0x1234ABCD)
+
+	g, ok := LookupGame(0x1234ABCD)
+	if !ok {
+		t.Fatal("game missing after loading")
+	}
+	want := GameInfo{CRC32: 0x1234ABCD, MapperNum: 1, MapperMirroring: true, Battery: true, Timing: TimingPAL,
+		PRGNVRAMSize: 8192, CHRRAMSize: 8192, ExpansionDevice: 1, Title: "Some MMC1 Game (USA)"}
+	if g != want {
+		t.Errorf("got %+v, want %+v", g, want)
+	}
+	if _, ok := LookupGame(0x2345BCDE); ok {
+		t.Error("game with a trainer was loaded")
+	}
+	if _, ok := LookupGame(0x3337EC46); !ok {
+		t.Error("built-in entries were dropped")
+	}
+}
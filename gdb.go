@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// GDBServer speaks the GDB remote serial protocol over a connection,
+// driving a Debugger.
+//
+// Registers are sent in the order A, X, Y, P, S (one byte each) and PC
+// (two bytes, little endian), as described by the target.xml it serves.
+// Memory writes patch RAM and PRG-ROM directly; writes to PPU, APU and
+// other mapper registers act like the CPU made them.
+type GDBServer struct {
+	d *Debugger
+
+	breakpoints map[uint16]*Breakpoint
+	watchpoints map[gdbWatch]*Watchpoint
+
+	w     *bufio.Writer
+	noAck bool
+}
+
+type gdbWatch struct {
+	kind byte
+	addr uint16
+	len  uint16
+}
+
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.nes.6502">
+    <reg name="a" bitsize="8" regnum="0"/>
+    <reg name="x" bitsize="8" regnum="1"/>
+    <reg name="y" bitsize="8" regnum="2"/>
+    <reg name="p" bitsize="8" regnum="3"/>
+    <reg name="s" bitsize="8" regnum="4"/>
+    <reg name="pc" bitsize="16" regnum="5" type="code_ptr"/>
+  </feature>
+</target>`
+
+const gdbRegisters = 6
+
+// gdb signal numbers for stop replies
+const (
+	gdbSIGINT  = 2
+	gdbSIGTRAP = 5
+)
+
+func NewGDBServer(d *Debugger) *GDBServer {
+	return &GDBServer{
+		d:           d,
+		breakpoints: map[uint16]*Breakpoint{},
+		watchpoints: map[gdbWatch]*Watchpoint{},
+	}
+}
+
+// ListenAndServe accepts one client at a time on addr.
+func (s *GDBServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Printf("gdb: listening on %s\n", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		log.Printf("gdb: client %s attached\n", conn.RemoteAddr())
+		if err := s.Serve(conn); err != nil {
+			log.Printf("gdb: %v\n", err)
+		}
+		conn.Close()
+		log.Printf("gdb: client detached\n")
+	}
+}
+
+type gdbEvent struct {
+	packet    string
+	valid     bool
+	interrupt bool
+	err       error
+}
+
+// Serve handles one client until it detaches or the connection closes.
+func (s *GDBServer) Serve(conn io.ReadWriter) error {
+	s.w = bufio.NewWriter(conn)
+	s.noAck = false
+
+	events := make(chan gdbEvent)
+	done := make(chan struct{})
+	defer close(done)
+	go readGDBEvents(bufio.NewReader(conn), events, done)
+
+	for ev := range events {
+		if ev.err != nil {
+			if ev.err == io.EOF {
+				return nil
+			}
+			return ev.err
+		}
+		if ev.interrupt {
+			// the machine is stopped already
+			s.send(fmt.Sprintf("S%02x", gdbSIGINT))
+			continue
+		}
+		if !s.noAck {
+			if !ev.valid {
+				s.raw("-")
+				continue
+			}
+			s.raw("+")
+		}
+
+		reply, resume, quit := s.handle(ev.packet)
+		if resume != nil {
+			var err error
+			if reply, err = s.resume(resume, events); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+		s.send(reply)
+		if quit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readGDBEvents splits the byte stream into packets and interrupts.
+func readGDBEvents(r *bufio.Reader, events chan<- gdbEvent, done <-chan struct{}) {
+	emit := func(ev gdbEvent) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			emit(gdbEvent{err: err})
+			return
+		}
+		switch b {
+		case 0x03:
+			if !emit(gdbEvent{interrupt: true}) {
+				return
+			}
+		case '$':
+			data, err := r.ReadString('#')
+			if err != nil {
+				emit(gdbEvent{err: err})
+				return
+			}
+			var sum [2]byte
+			if _, err := io.ReadFull(r, sum[:]); err != nil {
+				emit(gdbEvent{err: err})
+				return
+			}
+			data = data[:len(data)-1]
+			want, err := strconv.ParseUint(string(sum[:]), 16, 8)
+			valid := err == nil && byte(want) == gdbChecksum(data)
+			if !emit(gdbEvent{packet: data, valid: valid}) {
+				return
+			}
+		}
+		// acks from the client are not needed, as packets are never
+		// resent
+	}
+}
+
+func gdbChecksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+func (s *GDBServer) raw(data string) {
+	s.w.WriteString(data)
+	s.w.Flush()
+}
+
+func (s *GDBServer) send(data string) {
+	s.raw(fmt.Sprintf("$%s#%02x", data, gdbChecksum(data)))
+}
+
+// resume runs step or continue on another goroutine, so an interrupt
+// from the client can stop it, and returns the stop reply. When the
+// connection fails it stops the machine and returns the error.
+func (s *GDBServer) resume(run func() Stop, events <-chan gdbEvent) (string, error) {
+	result := make(chan Stop, 1)
+	go func() {
+		result <- run()
+	}()
+	var err error
+	for {
+		select {
+		case stop := <-result:
+			if err != nil {
+				return "", err
+			}
+			return s.stopReply(stop), nil
+		case ev := <-events:
+			// only an interrupt is valid while running
+			if ev.err != nil {
+				// the reader is done, so wait for the machine alone
+				err = ev.err
+				events = nil
+			}
+			if ev.interrupt || ev.err != nil {
+				s.d.Interrupt()
+			}
+		}
+	}
+}
+
+func (s *GDBServer) stopReply(stop Stop) string {
+	if stop.Reason == StopInterrupted {
+		return fmt.Sprintf("S%02x", gdbSIGINT)
+	}
+	if w := stop.Watchpoint; w != nil && w.Space == SpaceCPU && stop.Access != AccessExecute {
+		kind := "awatch"
+		switch w.Access {
+		case AccessWrite:
+			kind = "watch"
+		case AccessRead:
+			kind = "rwatch"
+		}
+		return fmt.Sprintf("T%02x%s:%04x;", gdbSIGTRAP, kind, stop.Addr)
+	}
+	return fmt.Sprintf("S%02x", gdbSIGTRAP)
+}
+
+// handle answers a packet. It returns a function to run instead when the
+// packet resumes the machine, and whether the client is done.
+func (s *GDBServer) handle(packet string) (reply string, resume func() Stop, quit bool) {
+	if packet == "" {
+		return "", nil, false
+	}
+	d := s.d
+	c := d.nes.CPU
+	cmd, args := packet[0], packet[1:]
+
+	switch cmd {
+	case '?':
+		return fmt.Sprintf("S%02x", gdbSIGTRAP), nil, false
+	case 'g':
+		return hex.EncodeToString(s.registers()), nil, false
+	case 'G':
+		b, err := hex.DecodeString(args)
+		if err != nil || len(b) < gdbRegisters+1 {
+			return "E01", nil, false
+		}
+		s.setRegisters(b)
+		return "OK", nil, false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || n >= gdbRegisters {
+			return "E01", nil, false
+		}
+		regs := s.registers()
+		if n == 5 {
+			return hex.EncodeToString(regs[5:7]), nil, false
+		}
+		return hex.EncodeToString(regs[n : n+1]), nil, false
+	case 'P':
+		parts := strings.SplitN(args, "=", 2)
+		if len(parts) != 2 {
+			return "E01", nil, false
+		}
+		n, err := strconv.ParseUint(parts[0], 16, 8)
+		value, err2 := hex.DecodeString(parts[1])
+		if err != nil || err2 != nil || n >= gdbRegisters {
+			return "E01", nil, false
+		}
+		// PC is the only two byte register
+		if size := 1 + int(n/5); len(value) != size {
+			return "E01", nil, false
+		}
+		regs := s.registers()
+		copy(regs[n:], value)
+		s.setRegisters(regs)
+		return "OK", nil, false
+	case 'm':
+		addr, length, ok := parseGDBRange(args)
+		if !ok {
+			return "E01", nil, false
+		}
+		data := make([]byte, length)
+		for i := range data {
+			data[i] = c.bus.Peek(addr + uint16(i))
+		}
+		return hex.EncodeToString(data), nil, false
+	case 'M':
+		parts := strings.SplitN(args, ":", 2)
+		addr, length, ok := parseGDBRange(parts[0])
+		if !ok || len(parts) != 2 {
+			return "E01", nil, false
+		}
+		data, err := hex.DecodeString(parts[1])
+		if err != nil || len(data) != length {
+			return "E01", nil, false
+		}
+		for i, b := range data {
+			d.nes.Poke(SpaceCPU, int(addr)+i, b)
+		}
+		return "OK", nil, false
+	case 'c', 's':
+		if args != "" {
+			addr, err := strconv.ParseUint(args, 16, 16)
+			if err != nil {
+				return "E01", nil, false
+			}
+			c.PC = uint16(addr)
+		}
+		if cmd == 's' {
+			return "", d.StepInto, false
+		}
+		return "", d.Continue, false
+	case 'Z', 'z':
+		return s.breakpoint(cmd == 'Z', args), nil, false
+	case 'H':
+		return "OK", nil, false
+	case 'k':
+		return "", nil, true
+	case 'D':
+		return "OK", nil, true
+	case 'q', 'Q':
+		return s.query(packet), nil, false
+	}
+	return "", nil, false
+}
+
+func (s *GDBServer) query(packet string) string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return "PacketSize=1000;qXfer:features:read+;QStartNoAckMode+"
+	case packet == "QStartNoAckMode":
+		s.noAck = true
+		return "OK"
+	case packet == "qAttached":
+		return "1"
+	case packet == "qC":
+		return "QC1"
+	case packet == "qfThreadInfo":
+		return "m1"
+	case packet == "qsThreadInfo":
+		return "l"
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		var offset, length int
+		if _, err := fmt.Sscanf(packet[len("qXfer:features:read:target.xml:"):], "%x,%x", &offset, &length); err != nil {
+			return "E01"
+		}
+		if offset >= len(gdbTargetXML) {
+			return "l"
+		}
+		end := offset + length
+		if end >= len(gdbTargetXML) {
+			return "l" + gdbTargetXML[offset:]
+		}
+		return "m" + gdbTargetXML[offset:end]
+	}
+	return ""
+}
+
+// breakpoint handles Z/z packets: type 0 and 1 are breakpoints, 2, 3
+// and 4 write, read and access watchpoints.
+func (s *GDBServer) breakpoint(insert bool, args string) string {
+	parts := strings.Split(args, ",")
+	if len(parts) < 3 {
+		return "E01"
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	kind, err := strconv.ParseUint(parts[2], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+
+	d := s.d
+	switch parts[0] {
+	case "0", "1":
+		if !insert {
+			if b, ok := s.breakpoints[uint16(addr)]; ok {
+				d.Delete(b.ID)
+				delete(s.breakpoints, uint16(addr))
+			}
+			return "OK"
+		}
+		if _, ok := s.breakpoints[uint16(addr)]; !ok {
+			s.breakpoints[uint16(addr)] = d.AddBreakpoint(uint16(addr), nil)
+		}
+		return "OK"
+	case "2", "3", "4":
+		access := map[string]Access{
+			"2": AccessWrite,
+			"3": AccessRead,
+			"4": AccessRead | AccessWrite,
+		}[parts[0]]
+		key := gdbWatch{parts[0][0], uint16(addr), uint16(kind)}
+		if !insert {
+			if w, ok := s.watchpoints[key]; ok {
+				d.Delete(w.ID)
+				delete(s.watchpoints, key)
+			}
+			return "OK"
+		}
+		if kind == 0 {
+			kind = 1
+		}
+		if _, ok := s.watchpoints[key]; !ok {
+			s.watchpoints[key] = d.AddWatchpoint(SpaceCPU, uint16(addr), uint16(addr)+uint16(kind)-1, access, nil)
+		}
+		return "OK"
+	}
+	return ""
+}
+
+func (s *GDBServer) registers() []byte {
+	c := s.d.nes.CPU
+	return []byte{c.A, c.X, c.Y, c.P, c.S, byte(c.PC), byte(c.PC >> 8)}
+}
+
+func (s *GDBServer) setRegisters(b []byte) {
+	c := s.d.nes.CPU
+	c.A, c.X, c.Y, c.P, c.S = b[0], b[1], b[2], b[3], b[4]
+	c.PC = uint16(b[5]) | uint16(b[6])<<8
+}
+
+func parseGDBRange(s string) (uint16, int, bool) {
+	parts := strings.SplitN(s, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	addr, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil || length > 0x1000 {
+		return 0, 0, false
+	}
+	return uint16(addr), int(length), true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type gdbTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *gdbTestClient) send(packet string) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "$%s#%02x", packet, gdbChecksum(packet)); err != nil {
+		c.t.Fatal(err)
+	}
+	if b, err := c.r.ReadByte(); err != nil || b != '+' {
+		c.t.Fatalf("%s: got ack %q, %v", packet, b, err)
+	}
+}
+
+func (c *gdbTestClient) reply() string {
+	c.t.Helper()
+	if b, err := c.r.ReadByte(); err != nil || b != '$' {
+		c.t.Fatalf("got %q, %v; want a packet", b, err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var sum [2]byte
+	if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	data = data[:len(data)-1]
+	if want := fmt.Sprintf("%02x", gdbChecksum(data)); string(sum[:]) != want {
+		c.t.Fatalf("%s: checksum %s, want %s", data, sum[:], want)
+	}
+	return data
+}
+
+func (c *gdbTestClient) expect(packet, want string) {
+	c.t.Helper()
+	c.send(packet)
+	if got := c.reply(); got != want {
+		c.t.Errorf("%s: got %q, want %q", packet, got, want)
+	}
+}
+
+func TestGDBServer(t *testing.T) {
+	n := testNES(t, testLoopINES())
+	n.PowerOn()
+	d := NewDebugger(n)
+	defer d.Detach()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() { served <- NewGDBServer(d).Serve(server) }()
+	c := &gdbTestClient{t: t, conn: client, r: bufio.NewReader(client)}
+
+	c.expect("?", "S05")
+	c.send("g")
+	if regs := c.reply(); len(regs) != 14 || regs[10:] != "0080" {
+		t.Errorf("g: got %q, want 7 registers with PC $8000", regs)
+	}
+	c.expect("m8000,3", "4c0080")
+
+	c.expect("P0=aabbcc", "E01")
+	c.expect("P5=aa", "E01")
+	c.expect("P1=12", "OK")
+	c.expect("p1", "12")
+	c.expect("p2", "00")
+	c.expect("P5=0080", "OK")
+
+	// ROM is patched, not written through the mapper
+	c.expect("M8001,1:01", "OK")
+	c.expect("m8000,3", "4c0180")
+	if n.ROM.PRG[1] != 0x01 {
+		t.Errorf("PRG-ROM byte 1 = %02X after M", n.ROM.PRG[1])
+	}
+	c.expect("M8001,1:00", "OK")
+	c.expect("M0010,2:beef", "OK")
+	c.expect("m0010,2", "beef")
+
+	// the loop comes back to the breakpoint after one instruction
+	c.expect("Z0,8000,1", "OK")
+	c.expect("c", "S05")
+	c.expect("z0,8000,1", "OK")
+
+	c.send("c")
+	client.Write([]byte{0x03})
+	if got := c.reply(); got != "S02" {
+		t.Errorf("interrupt: got %q, want S02", got)
+	}
+
+	// a client going away while running stops the machine and the server
+	c.send("c")
+	client.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the client disconnected")
+	}
+}
@@ -1,3 +1,6 @@
+//go:build !headless
+// +build !headless
+
 package main
 
 import (
@@ -19,15 +22,8 @@ type GLRenderer struct {
 	texture uint32
 }
 
-func NewGLRenderer(window *glfw.Window) Renderer {
-	var texture uint32
-	gl.GenTextures(1, &texture)
-	gl.BindTexture(gl.TEXTURE_2D, texture)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
-	gl.BindTexture(gl.TEXTURE_2D, 0)
+func NewGLRenderer(window *glfw.Window) *GLRenderer {
+	texture := newTexture()
 	return &GLRenderer{
 		window: window,
 		image: &image.RGBA{
@@ -54,26 +50,50 @@ func (g *GLRenderer) SetPixel(x, y int, col color.RGBA) {
 	g.image.Pix[base+3] = col.A
 }
 
+// Present draws a finished frame, e.g. one taken from a TripleBuffer.
+func (g *GLRenderer) Present(img *image.RGBA) {
+	copy(g.image.Pix, img.Pix)
+	g.Render()
+}
+
 func (g *GLRenderer) Render() {
+	drawImage(g.window, g.texture, g.image)
+}
+
+func newTexture() uint32 {
+	var texture uint32
+	gl.GenTextures(1, &texture)
+	gl.BindTexture(gl.TEXTURE_2D, texture)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+	return texture
+}
+
+// drawImage draws img on window, scaled to fit while keeping its aspect
+// ratio.
+func drawImage(window *glfw.Window, texture uint32, img *image.RGBA) {
 	gl.Clear(gl.COLOR_BUFFER_BIT)
 	gl.MatrixMode(gl.MODELVIEW)
 	gl.LoadIdentity()
 
-	s := g.image.Rect.Size()
+	s := img.Rect.Size()
 
-	gl.BindTexture(gl.TEXTURE_2D, g.texture)
+	gl.BindTexture(gl.TEXTURE_2D, texture)
 
 	gl.TexImage2D(
 		gl.TEXTURE_2D, 0,
 		gl.RGBA,
 		int32(s.X), int32(s.Y), 0,
 		gl.RGBA,
-		gl.UNSIGNED_BYTE, gl.Ptr(g.image.Pix),
+		gl.UNSIGNED_BYTE, gl.Ptr(img.Pix),
 	)
 
-	w, h := g.window.GetFramebufferSize()
-	s1 := float32(w) / 256
-	s2 := float32(h) / 240
+	w, h := window.GetFramebufferSize()
+	s1 := float32(w) / float32(s.X)
+	s2 := float32(h) / float32(s.Y)
 	f := float32(1)
 	var x, y float32
 	if s1 >= s2 {
@@ -95,5 +115,44 @@ func (g *GLRenderer) Render() {
 	gl.End()
 
 	gl.BindTexture(gl.TEXTURE_2D, 0)
-	g.window.SwapBuffers()
+	window.SwapBuffers()
+}
+
+// GLViewer is a window showing one of the debug views.
+type GLViewer struct {
+	window  *glfw.Window
+	texture uint32
+}
+
+// NewGLViewer opens a window, leaving the current context unchanged.
+func NewGLViewer(title string, width, height int) (*GLViewer, error) {
+	window, err := glfw.CreateWindow(width, height, title, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	current := glfw.GetCurrentContext()
+	window.MakeContextCurrent()
+	// swaps on the viewers must not wait for vsync on top of the main
+	// window
+	glfw.SwapInterval(0)
+	gl.Enable(gl.TEXTURE_2D)
+	v := &GLViewer{window: window, texture: newTexture()}
+	current.MakeContextCurrent()
+	return v, nil
+}
+
+// Show draws img, leaving the current context unchanged.
+func (v *GLViewer) Show(img *image.RGBA) {
+	current := glfw.GetCurrentContext()
+	v.window.MakeContextCurrent()
+	drawImage(v.window, v.texture, img)
+	current.MakeContextCurrent()
+}
+
+func (v *GLViewer) ShouldClose() bool {
+	return v.window.ShouldClose()
+}
+
+func (v *GLViewer) Destroy() {
+	v.window.Destroy()
 }
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const HeaderSize = 16
+
+type Mirroring int
+
+const (
+	MirroringHorizontal Mirroring = iota
+	MirroringVertical
+	MirroringFourScreen
+	MirroringSingleScreen0
+	MirroringSingleScreen1
+)
+
+func (m Mirroring) String() string {
+	switch m {
+	case MirroringHorizontal:
+		return "horizontal"
+	case MirroringVertical:
+		return "vertical"
+	case MirroringFourScreen:
+		return "four-screen"
+	case MirroringSingleScreen0:
+		return "single-screen(0)"
+	case MirroringSingleScreen1:
+		return "single-screen(1)"
+	}
+	return fmt.Sprintf("Mirroring(%d)", int(m))
+}
+
+type ConsoleType int
+
+const (
+	ConsoleNES ConsoleType = iota
+	ConsoleVs
+	ConsolePlayChoice
+	ConsoleExtended
+)
+
+func (c ConsoleType) String() string {
+	switch c {
+	case ConsoleNES:
+		return "NES/Famicom"
+	case ConsoleVs:
+		return "Vs. System"
+	case ConsolePlayChoice:
+		return "PlayChoice-10"
+	case ConsoleExtended:
+		return "extended"
+	}
+	return fmt.Sprintf("ConsoleType(%d)", int(c))
+}
+
+type Timing int
+
+const (
+	TimingNTSC Timing = iota
+	TimingPAL
+	TimingMulti
+	TimingDendy
+)
+
+func (t Timing) String() string {
+	switch t {
+	case TimingNTSC:
+		return "NTSC"
+	case TimingPAL:
+		return "PAL"
+	case TimingMulti:
+		return "multi-region"
+	case TimingDendy:
+		return "Dendy"
+	}
+	return fmt.Sprintf("Timing(%d)", int(t))
+}
+
+// Scanlines returns the number of scanlines the PPU draws per frame.
+func (t Timing) Scanlines() int {
+	switch t {
+	case TimingPAL, TimingDendy:
+		return 312
+	}
+	return 262
+}
+
+// FrameRate returns the number of frames the console draws per second.
+func (t Timing) FrameRate() float64 {
+	switch t {
+	case TimingPAL, TimingDendy:
+		return 50.007
+	}
+	return 60.0988
+}
+
+// PPUDotsPer5Cycles returns how many PPU dots are drawn in 5 CPU cycles:
+// 15 on NTSC and Dendy, 16 on PAL.
+func (t Timing) PPUDotsPer5Cycles() int {
+	if t == TimingPAL {
+		return 16
+	}
+	return 15
+}
+
+// CPUFrequency returns the CPU clock rate in Hz.
+func (t Timing) CPUFrequency() int {
+	switch t {
+	case TimingPAL:
+		return CPUFrequencyPAL
+	case TimingDendy:
+		return CPUFrequencyDendy
+	}
+	return CPUFrequency
+}
+
+const (
+	PRGROMUnit    = 16 * 1024
+	CHRROMUnit    = 8 * 1024
+	PRGRAMUnit    = 8 * 1024
+	DefaultCHRRAM = 8 * 1024
+)
+
+// max values of the enumerated NES 2.0 fields that are not reserved
+const (
+	maxVsPPUType           = 0x0C
+	maxVsHardwareType      = 0x06
+	maxExtendedConsoleType = 0x0C
+	maxExpansionDevice     = 0x3A
+)
+
+type Header struct {
+	NES20 bool
+
+	MapperNum int
+	SubMapper int
+
+	Mirroring Mirroring
+	Battery   bool
+	Trainer   bool
+
+	Console             ConsoleType
+	VsPPUType           int
+	VsHardwareType      int
+	ExtendedConsoleType int
+
+	Timing Timing
+
+	PRGROMSize   int
+	CHRROMSize   int
+	PRGRAMSize   int
+	PRGNVRAMSize int
+	CHRRAMSize   int
+	CHRNVRAMSize int
+
+	MiscROMs        int
+	ExpansionDevice int
+}
+
+// ParseHeader decodes an iNES or NES 2.0 header.
+func ParseHeader(b [HeaderSize]byte) (Header, error) {
+	var h Header
+
+	if !(0x4E == b[0] &&
+		0x45 == b[1] &&
+		0x53 == b[2] &&
+		0x1A == b[3]) {
+		return h, ErrUnknownFormat
+	}
+
+	flag6 := b[6]
+	flag7 := b[7]
+
+	h.MapperNum = int(flag6&0xF0>>4) | int(flag7&0xF0)
+	h.Trainer = flag6&0x04 != 0
+	h.Battery = flag6&0x02 != 0
+	switch {
+	case flag6&0x08 != 0:
+		h.Mirroring = MirroringFourScreen
+	case flag6&0x01 != 0:
+		h.Mirroring = MirroringVertical
+	default:
+		h.Mirroring = MirroringHorizontal
+	}
+
+	switch flag7 & 0x0C {
+	case 0x04, 0x0C:
+		return h, &HeaderError{"version", fmt.Sprintf("archaic or reserved identifier %02x", flag7&0x0C)}
+	case 0x08:
+		h.NES20 = true
+	}
+
+	if h.NES20 {
+		if err := h.parseNES20(b); err != nil {
+			return h, err
+		}
+	} else {
+		h.parseINES(b)
+	}
+
+	if err := h.validate(); err != nil {
+		return h, err
+	}
+
+	return h, nil
+}
+
+func (h *Header) parseINES(b [HeaderSize]byte) {
+	flag7 := b[7]
+
+	switch {
+	case flag7&0x01 != 0:
+		h.Console = ConsoleVs
+	case flag7&0x02 != 0:
+		h.Console = ConsolePlayChoice
+	default:
+		h.Console = ConsoleNES
+	}
+
+	h.PRGROMSize = int(b[4]) * PRGROMUnit
+	h.CHRROMSize = int(b[5]) * CHRROMUnit
+
+	// a value of 0 infers 8KB for compatibility
+	prg_ram := int(b[8])
+	if prg_ram == 0 {
+		prg_ram = 1
+	}
+	if h.Battery {
+		h.PRGNVRAMSize = prg_ram * PRGRAMUnit
+	} else {
+		h.PRGRAMSize = prg_ram * PRGRAMUnit
+	}
+
+	if h.CHRROMSize == 0 {
+		h.CHRRAMSize = DefaultCHRRAM
+	}
+
+	if b[9]&0x01 != 0 {
+		h.Timing = TimingPAL
+	} else {
+		h.Timing = TimingNTSC
+	}
+}
+
+func (h *Header) parseNES20(b [HeaderSize]byte) error {
+	h.Console = ConsoleType(b[7] & 0x03)
+
+	h.MapperNum |= int(b[8]&0x0F) << 8
+	h.SubMapper = int(b[8] & 0xF0 >> 4)
+
+	prg, err := romSize(b[4], b[9]&0x0F, PRGROMUnit)
+	if err != nil {
+		return &HeaderError{"PRG-ROM size", err.Error()}
+	}
+	h.PRGROMSize = prg
+
+	chr, err := romSize(b[5], b[9]&0xF0>>4, CHRROMUnit)
+	if err != nil {
+		return &HeaderError{"CHR-ROM size", err.Error()}
+	}
+	h.CHRROMSize = chr
+
+	h.PRGRAMSize = ramSize(b[10] & 0x0F)
+	h.PRGNVRAMSize = ramSize(b[10] & 0xF0 >> 4)
+	h.CHRRAMSize = ramSize(b[11] & 0x0F)
+	h.CHRNVRAMSize = ramSize(b[11] & 0xF0 >> 4)
+	if h.CHRROMSize == 0 && h.CHRRAMSize == 0 && h.CHRNVRAMSize == 0 {
+		// headers without any CHR memory are most likely written by
+		// tools that forgot to fill in the CHR-RAM size
+		h.CHRRAMSize = DefaultCHRRAM
+	}
+
+	h.Timing = Timing(b[12] & 0x03)
+
+	switch h.Console {
+	case ConsoleVs:
+		h.VsPPUType = int(b[13] & 0x0F)
+		h.VsHardwareType = int(b[13] & 0xF0 >> 4)
+	case ConsoleExtended:
+		h.ExtendedConsoleType = int(b[13] & 0x0F)
+	}
+
+	h.MiscROMs = int(b[14] & 0x03)
+	h.ExpansionDevice = int(b[15] & 0x3F)
+
+	return nil
+}
+
+// romSize decodes a NES 2.0 ROM size from its LSB and MSB nibble.
+// When the MSB nibble is $F, the LSB is in exponent-multiplier notation
+// (EEEEEEMM): size = 2^E * (MM*2+1) bytes.
+func romSize(lsb, msb byte, unit int) (int, error) {
+	if msb != 0x0F {
+		return (int(msb)<<8 | int(lsb)) * unit, nil
+	}
+	exponent := uint(lsb >> 2)
+	multiplier := int(lsb&0x03)*2 + 1
+	if exponent > 30 {
+		return 0, fmt.Errorf("exponent %d is too large", exponent)
+	}
+	return (1 << exponent) * multiplier, nil
+}
+
+// ramSize decodes a NES 2.0 RAM shift count: 64 << shift, or 0.
+func ramSize(shift byte) int {
+	if shift == 0 {
+		return 0
+	}
+	return 64 << uint(shift)
+}
+
+func (h *Header) validate() error {
+	if h.PRGROMSize == 0 {
+		return &HeaderError{"PRG-ROM size", "zero"}
+	}
+	if h.VsPPUType > maxVsPPUType {
+		return &HeaderError{"Vs. PPU type", fmt.Sprintf("reserved value %d", h.VsPPUType)}
+	}
+	if h.VsHardwareType > maxVsHardwareType {
+		return &HeaderError{"Vs. hardware type", fmt.Sprintf("reserved value %d", h.VsHardwareType)}
+	}
+	if h.ExtendedConsoleType > maxExtendedConsoleType {
+		return &HeaderError{"extended console type", fmt.Sprintf("reserved value %d", h.ExtendedConsoleType)}
+	}
+	if h.ExpansionDevice > maxExpansionDevice {
+		return &HeaderError{"expansion device", fmt.Sprintf("reserved value %d", h.ExpansionDevice)}
+	}
+	return nil
+}
+
+// HasPC10InstROM reports whether the image carries the PlayChoice-10
+// INST-ROM after CHR-ROM.
+func (h *Header) HasPC10InstROM() bool {
+	return h.Console == ConsolePlayChoice
+}
+
+// cleanHeader clears bytes 7-15 of an iNES 1.0 header that was garbled
+// by old dumping tools, which would otherwise corrupt the upper mapper
+// nibble: either the "DiskDude!" tag, or junk in bytes 12-15 of a
+// version 0 header. Other headers are left for ParseHeader to validate.
+// It reports whether anything was cleared.
+func cleanHeader(b *[HeaderSize]byte) bool {
+	switch {
+	case bytes.Equal(b[7:], []byte("DiskDude!")):
+	case b[7]&0x0C == 0x00 && (b[12] != 0 || b[13] != 0 || b[14] != 0 || b[15] != 0):
+	default:
+		return false
+	}
+	for i := 7; i < HeaderSize; i++ {
+		b[i] = 0
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// infoCommand prints the header of a ROM, its hashes and any
+// discrepancies with the game database.
+func infoCommand(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	configFlags := NewConfigFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: nes info [flags] rom.nes")
+	}
+
+	config, err := configFlags.Config()
+	if err != nil {
+		return err
+	}
+	// the header is printed as stored; discrepancies are listed below
+	config.DBPolicy = DBPolicyHeader
+
+	r, err := LoadROM(fs.Arg(0), config)
+	if err != nil {
+		return err
+	}
+
+	printInfo(os.Stdout, r)
+	return nil
+}
+
+func printInfo(w io.Writer, r *rom) {
+	h := r.Header
+
+	format := "iNES"
+	if h.NES20 {
+		format = "NES 2.0"
+	}
+	if r.Board != "" {
+		format = "UNIF"
+	}
+	fmt.Fprintf(w, "Format:           %s\n", format)
+	if r.Board != "" {
+		fmt.Fprintf(w, "Board:            %s\n", r.Board)
+	}
+	fmt.Fprintf(w, "Mapper:           %d.%d\n", h.MapperNum, h.SubMapper)
+	fmt.Fprintf(w, "Mirroring:        %v\n", h.Mirroring)
+	fmt.Fprintf(w, "Battery:          %v\n", h.Battery)
+	fmt.Fprintf(w, "Trainer:          %v\n", h.Trainer)
+	fmt.Fprintf(w, "Console:          %v\n", h.Console)
+	switch h.Console {
+	case ConsoleVs:
+		fmt.Fprintf(w, "Vs. PPU:          %d\n", h.VsPPUType)
+		fmt.Fprintf(w, "Vs. hardware:     %d\n", h.VsHardwareType)
+	case ConsoleExtended:
+		fmt.Fprintf(w, "Extended console: %d\n", h.ExtendedConsoleType)
+	}
+	fmt.Fprintf(w, "Timing:           %v\n", h.Timing)
+	fmt.Fprintf(w, "PRG-ROM:          %d\n", h.PRGROMSize)
+	fmt.Fprintf(w, "CHR-ROM:          %d\n", h.CHRROMSize)
+	fmt.Fprintf(w, "PRG-RAM:          %d\n", h.PRGRAMSize)
+	fmt.Fprintf(w, "PRG-NVRAM:        %d\n", h.PRGNVRAMSize)
+	fmt.Fprintf(w, "CHR-RAM:          %d\n", h.CHRRAMSize)
+	fmt.Fprintf(w, "CHR-NVRAM:        %d\n", h.CHRNVRAMSize)
+	fmt.Fprintf(w, "Misc ROMs:        %d\n", h.MiscROMs)
+	fmt.Fprintf(w, "Expansion device: %d\n", h.ExpansionDevice)
+	fmt.Fprintln(w)
+
+	sha := sha1.New()
+	sha.Write(r.PRG)
+	if h.CHRROMSize > 0 {
+		sha.Write(r.CHR)
+	}
+	fmt.Fprintf(w, "PRG CRC32:        %08X\n", crc32.ChecksumIEEE(r.PRG))
+	if h.CHRROMSize > 0 {
+		fmt.Fprintf(w, "CHR CRC32:        %08X\n", crc32.ChecksumIEEE(r.CHR))
+	}
+	fmt.Fprintf(w, "PRG+CHR CRC32:    %08X\n", r.CRC32())
+	fmt.Fprintf(w, "PRG+CHR SHA-1:    %X\n", sha.Sum(nil))
+	fmt.Fprintln(w)
+
+	g, ok := LookupGame(r.CRC32())
+	if !ok {
+		fmt.Fprintln(w, "Database:         not found")
+		return
+	}
+	fmt.Fprintf(w, "Database:         %s\n", g.Title)
+	diff := g.Diff(h)
+	if len(diff) == 0 {
+		fmt.Fprintln(w, "                  header matches")
+	}
+	for _, d := range diff {
+		fmt.Fprintf(w, "                  %s\n", d)
+	}
+}
@@ -1,60 +1,33 @@
 package main
 
 import (
+	"log"
 	"os"
-
-	"github.com/go-gl/gl/v2.1/gl"
-	"github.com/go-gl/glfw/v3.2/glfw"
 )
 
-func main() {
-
-	if err := glfw.Init(); err != nil {
-		panic(err)
-	}
-	defer glfw.Terminate()
-
-	glfw.WindowHint(glfw.Resizable, glfw.True)
-	glfw.WindowHint(glfw.ContextVersionMajor, 2)
-	glfw.WindowHint(glfw.ContextVersionMinor, 1)
-
-	window, err := glfw.CreateWindow(300, 300, "nes", nil, nil)
-	if err != nil {
-		panic(err)
-	}
-	window.MakeContextCurrent()
-
-	if err := gl.Init(); err != nil {
-		panic(err)
-	}
-	gl.Enable(gl.TEXTURE_2D)
-
-	r := NewGLRenderer(window)
+// commands are the subcommands of nes. Without one, the ROM is run.
+var commands = map[string]func(args []string) error{
+	"info":     infoCommand,
+	"run":      runCommand,
+	"test":     testCommand,
+	"trace":    traceCommand,
+	"disasm":   disasmCommand,
+	"debug":    debugCommand,
+	"cdl":      cdlCommand,
+	"profile":  profileCommand,
+	"dump-ppu": dumpPPUCommand,
+}
 
-	nes, err := NewNES(os.Args[1], r)
-	if err != nil {
-		panic(err)
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
 	}
-
-	//fmt.Println("======CPU=======")
-	//for i := uint16(0); i < 0xFFFF; i++ {
-	//	if i%16 == 0 {
-	//		fmt.Printf("\n%04x: ", i)
-	//	}
-	//	fmt.Printf("%04x ", nes.CPU.get(i))
-	//}
-	//fmt.Println("======PPU=======")
-	//for i := uint16(0); i < 0x4000; i++ {
-	//	if i%16 == 0 {
-	//		fmt.Printf("\n%04x: ", i)
-	//	}
-	//	fmt.Printf("%04x ", nes.PPU.get(i))
-	//}
-
-	nes.PowerOn()
-
-	for !window.ShouldClose() {
-		nes.Tick()
-		glfw.PollEvents()
+	if err := runCommand(os.Args[1:]); err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SpaceSize returns the number of addresses in space.
+func (n *NES) SpaceSize(space Space) int {
+	switch space {
+	case SpaceCPU:
+		return 0x10000
+	case SpacePPU:
+		return PPUAddressVRAM_Limit
+	case SpaceOAM:
+		return len(n.PPU.oam)
+	case SpacePalette:
+		return 0x20
+	case SpacePRGRAM:
+		return len(n.ROM.PRGRAM)
+	}
+	return 0
+}
+
+// Peek returns what reading addr in space would, without the side
+// effects of a real read, like clearing vblank on $2002 or advancing the
+// controller shift registers.
+func (n *NES) Peek(space Space, addr int) byte {
+	switch space {
+	case SpaceCPU:
+		return n.CPUBus.Peek(uint16(addr))
+	case SpacePPU:
+		return n.PPUBus.Peek(uint16(addr))
+	case SpaceOAM:
+		return n.PPU.oam[addr&0xFF]
+	case SpacePalette:
+		return n.PPUBus.Peek(PPUAddressPaletteBG + uint16(addr&0x1F))
+	case SpacePRGRAM:
+		if addr < len(n.ROM.PRGRAM) {
+			return n.ROM.PRGRAM[addr]
+		}
+	}
+	return 0
+}
+
+// PeekValue peeks a value of format at addr in space.
+func (n *NES) PeekValue(space Space, addr int, format WatchFormat) int {
+	raw := 0
+	for i := format.Size() - 1; i >= 0; i-- {
+		raw = raw<<8 | int(n.Peek(space, addr+i))
+	}
+	return format.decode(raw)
+}
+
+// Read reads addr in space like the CPU or PPU would, side effects
+// included.
+func (n *NES) Read(space Space, addr int) byte {
+	switch space {
+	case SpaceCPU:
+		return n.CPUBus.Get(uint16(addr))
+	case SpacePPU:
+		return n.PPUBus.Get(uint16(addr))
+	}
+	return n.Peek(space, addr)
+}
+
+// Poke writes value to addr in space. CPU RAM and PRG-ROM mapped into
+// the CPU space are written directly, other CPU and PPU addresses go
+// through the bus like a real write.
+func (n *NES) Poke(space Space, addr int, value byte) {
+	switch space {
+	case SpaceCPU:
+		if addr < AddressPPUCtrl {
+			n.wram[addr%len(n.wram)] = value
+			return
+		}
+		if offset := n.PRGOffset(uint16(addr)); offset >= 0 && offset < len(n.ROM.PRG) {
+			n.ROM.PRG[offset] = value
+			return
+		}
+		n.CPUBus.Set(uint16(addr), value)
+	case SpacePPU:
+		n.PPUBus.Set(uint16(addr), value)
+	case SpaceOAM:
+		n.PPU.oam[addr&0xFF] = value
+	case SpacePalette:
+		n.PPUBus.Set(PPUAddressPaletteBG+uint16(addr&0x1F), value)
+	case SpacePRGRAM:
+		if addr < len(n.ROM.PRGRAM) {
+			n.ROM.PRGRAM[addr] = value
+		}
+	}
+}
+
+// HexDump writes length bytes of space from addr, 16 to a line.
+func (n *NES) HexDump(w io.Writer, space Space, addr, length int) {
+	size := n.SpaceSize(space)
+	for i := 0; i < length && addr+i < size; i += 16 {
+		fmt.Fprintf(w, "%04X:", addr+i)
+		text := ""
+		for j := i; j < i+16 && j < length && addr+j < size; j++ {
+			v := n.Peek(space, addr+j)
+			fmt.Fprintf(w, " %02X", v)
+			if v >= 0x20 && v < 0x7F {
+				text += string(rune(v))
+			} else {
+				text += "."
+			}
+		}
+		fmt.Fprintf(w, "%*s  %s\n", 3*(16-len(text)), "", text)
+	}
+}
+
+// WatchFormat is how a watched value is read and shown.
+type WatchFormat int
+
+const (
+	WatchU8 WatchFormat = iota
+	WatchS8
+	WatchU16
+	WatchS16
+	WatchBCD8
+	WatchBCD16
+)
+
+var watchFormatNames = []string{"u8", "s8", "u16", "s16", "bcd8", "bcd16"}
+
+func (f WatchFormat) String() string {
+	if int(f) < len(watchFormatNames) {
+		return watchFormatNames[f]
+	}
+	return fmt.Sprintf("WatchFormat(%d)", int(f))
+}
+
+func ParseWatchFormat(s string) (WatchFormat, bool) {
+	if s == "bcd" {
+		return WatchBCD8, true
+	}
+	for i, name := range watchFormatNames {
+		if s == name {
+			return WatchFormat(i), true
+		}
+	}
+	return 0, false
+}
+
+// Size returns the number of bytes a value takes. 16-bit values are
+// little endian.
+func (f WatchFormat) Size() int {
+	switch f {
+	case WatchU16, WatchS16, WatchBCD16:
+		return 2
+	}
+	return 1
+}
+
+// decode turns the bytes of a value into a number. BCD bytes hold two
+// decimal digits each.
+func (f WatchFormat) decode(raw int) int {
+	switch f {
+	case WatchS8:
+		return int(int8(raw))
+	case WatchS16:
+		return int(int16(raw))
+	case WatchBCD8, WatchBCD16:
+		v := 0
+		for shift := uint(8 * f.Size()); shift > 0; shift -= 4 {
+			v = v*10 + raw>>(shift-4)&0xF
+		}
+		return v
+	}
+	return raw
+}
+
+// encode is the inverse of decode.
+func (f WatchFormat) encode(v int) int {
+	switch f {
+	case WatchBCD8, WatchBCD16:
+		raw := 0
+		for shift := uint(0); shift < uint(8*f.Size()); shift += 4 {
+			raw |= v % 10 << shift
+			v /= 10
+		}
+		return raw
+	}
+	return v & (1<<uint(8*f.Size()) - 1)
+}
+
+// Watch is a value in memory shown every frame, and optionally frozen.
+type Watch struct {
+	ID     int
+	Name   string
+	Space  Space
+	Addr   int
+	Format WatchFormat
+
+	Value int
+	// Changed is set when Value changed in the last frame, and
+	// ChangedFrame is the last frame it did.
+	Changed      bool
+	ChangedFrame int
+
+	Frozen      bool
+	FrozenValue int
+}
+
+func (w *Watch) String() string {
+	mark := " "
+	if w.Changed {
+		mark = "*"
+	}
+	frozen := ""
+	if w.Frozen {
+		frozen = fmt.Sprintf(" (frozen at %d)", w.FrozenValue)
+	}
+	s := fmt.Sprintf("%s%3d  %-6s $%04X %-5s %6d  %-16s%s", mark, w.ID, w.Space, w.Addr, w.Format, w.Value, w.Name, frozen)
+	return strings.TrimRight(s, " ")
+}
+
+func (w *Watch) read(n *NES) int {
+	return n.PeekValue(w.Space, w.Addr, w.Format)
+}
+
+func (w *Watch) write(n *NES, v int) {
+	raw := w.Format.encode(v)
+	for i := 0; i < w.Format.Size(); i++ {
+		n.Poke(w.Space, w.Addr+i, byte(raw>>uint(8*i)))
+	}
+}
+
+// WatchList is a RAM watch. Set as NES.Watches, it is updated at the end
+// of every frame.
+type WatchList struct {
+	watches []*Watch
+	nextID  int
+
+	// OnChange is called for every value that changed in a frame.
+	OnChange func(w *Watch)
+}
+
+func NewWatchList() *WatchList {
+	return &WatchList{nextID: 1}
+}
+
+func (l *WatchList) Add(space Space, addr int, format WatchFormat, name string) *Watch {
+	w := &Watch{ID: l.nextID, Name: name, Space: space, Addr: addr, Format: format, ChangedFrame: -1}
+	l.nextID++
+	l.watches = append(l.watches, w)
+	return w
+}
+
+func (l *WatchList) Get(id int) *Watch {
+	for _, w := range l.watches {
+		if w.ID == id {
+			return w
+		}
+	}
+	return nil
+}
+
+func (l *WatchList) Remove(id int) bool {
+	for i, w := range l.watches {
+		if w.ID == id {
+			l.watches = append(l.watches[:i], l.watches[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *WatchList) Watches() []*Watch {
+	return l.watches
+}
+
+// Update applies the frozen values and reads the watched ones.
+func (l *WatchList) Update(n *NES) {
+	for _, w := range l.watches {
+		if w.Frozen {
+			w.write(n, w.FrozenValue)
+		}
+		v := w.read(n)
+		w.Changed = v != w.Value && w.ChangedFrame >= 0
+		if w.Changed || w.ChangedFrame < 0 {
+			w.ChangedFrame = n.PPU.Frame
+		}
+		w.Value = v
+		if w.Changed && l.OnChange != nil {
+			l.OnChange(w)
+		}
+	}
+}
+
+// Freeze holds w at value from now on.
+func (l *WatchList) Freeze(n *NES, w *Watch, value int) {
+	w.Frozen = true
+	w.FrozenValue = value
+	w.write(n, value)
+	w.Value = w.read(n)
+}
+
+func (l *WatchList) Write(out io.Writer) {
+	for _, w := range l.watches {
+		fmt.Fprintln(out, w)
+	}
+}
+
+// ParseWatch parses "[SPACE:]ADDR[:FORMAT[:NAME]]" and adds the watch,
+// e.g. "$75:u8:lives" or "prgram:$100:bcd16:score".
+func (l *WatchList) ParseWatch(spec string) (*Watch, error) {
+	parts := strings.SplitN(spec, ":", 4)
+	space := SpaceCPU
+	if s, ok := ParseSpace(parts[0]); ok {
+		space, parts = s, parts[1:]
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("bad watch %q", spec)
+	}
+	addr, err := parseNumber(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad watch %q: %v", spec, err)
+	}
+	format := WatchU8
+	if len(parts) > 1 && parts[1] != "" {
+		var ok bool
+		if format, ok = ParseWatchFormat(parts[1]); !ok {
+			return nil, fmt.Errorf("bad watch %q: unknown format %q", spec, parts[1])
+		}
+	}
+	name := ""
+	if len(parts) > 2 {
+		name = strings.Join(parts[2:], ":")
+	}
+	return l.Add(space, addr, format, name), nil
+}
+
+// ParseFreeze parses "WATCH=VALUE", with WATCH as for ParseWatch, and
+// adds a frozen watch.
+func (l *WatchList) ParseFreeze(spec string) (*Watch, error) {
+	i := strings.LastIndex(spec, "=")
+	if i < 0 {
+		return nil, errors.New("usage: WATCH=VALUE")
+	}
+	value, err := parseNumber(spec[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("bad freeze %q: %v", spec, err)
+	}
+	w, err := l.ParseWatch(spec[:i])
+	if err != nil {
+		return nil, err
+	}
+	w.Frozen = true
+	w.FrozenValue = value
+	return w, nil
+}
@@ -3,12 +3,71 @@ package main
 type mmc interface {
 	Get(uint16) byte
 	Set(uint16, byte)
+	// Peek returns what Get would, without side effects.
+	Peek(uint16) byte
+}
+
+// mirroringController is implemented by mappers that switch nametable
+// mirroring at runtime.
+type mirroringController interface {
+	Mirroring() Mirroring
+}
+
+// irqSource is implemented by mappers that can assert the CPU's IRQ line.
+type irqSource interface {
+	IRQ() bool
+}
+
+// clocked is implemented by mappers that need to run every CPU cycle.
+type clocked interface {
+	Clock()
+}
+
+// saveDataHolder is implemented by mappers that keep save data other than
+// battery-backed PRG-RAM.
+type saveDataHolder interface {
+	SaveData() []byte
+	LoadSaveData([]byte) error
+}
+
+// prgMapper is implemented by mappers that can tell which PRG-ROM byte
+// is mapped at a CPU address.
+type prgMapper interface {
+	PRGOffset(addr uint16) (int, bool)
+}
+
+// chrMapper is implemented by mappers that can tell which CHR-ROM byte
+// is mapped at a PPU address.
+type chrMapper interface {
+	CHROffset(addr uint16) (int, bool)
+}
+
+// prgOffset returns the PRG-ROM offset m maps at addr, or -1.
+func prgOffset(m mmc, addr uint16) int {
+	if p, ok := m.(prgMapper); ok {
+		if offset, ok := p.PRGOffset(addr); ok {
+			return offset
+		}
+	}
+	return -1
+}
+
+// chrOffset returns the CHR-ROM offset m maps at addr, or -1.
+func chrOffset(m mmc, addr uint16) int {
+	if p, ok := m.(chrMapper); ok {
+		if offset, ok := p.CHROffset(addr); ok {
+			return offset
+		}
+	}
+	return -1
 }
 
 func NewMMC(mapper_num int, rom *rom) mmc {
 	switch mapper_num {
 	case 1:
 		return NewMMC1(rom)
+	case MapperFDS:
+		return NewFDS(rom)
 	}
 	return NewMMC0(rom)
 }
@@ -31,19 +31,42 @@ func (m *mmc0) Get(address uint16) byte {
 	case address < MMC0AddressBatteryRAM:
 		return 0
 	case address < MMC0AddressPRG0:
-		return 0
+		return m.rom.GetPRGRAM(address - MMC0AddressBatteryRAM)
 	case address < MMC0AddressPRG1:
 		return m.rom.GetPRG(address - MMC0AddressPRG0 + m.bankAddr1)
 	}
 	return m.rom.GetPRG(address - MMC0AddressPRG1 + m.bankAddr2)
 }
 
+// Peek is Get, which has no side effects.
+func (m *mmc0) Peek(address uint16) byte {
+	return m.Get(address)
+}
+
+func (m *mmc0) PRGOffset(address uint16) (int, bool) {
+	var offset int
+	switch {
+	case address < MMC0AddressPRG0:
+		return 0, false
+	case address < MMC0AddressPRG1:
+		offset = int(address - MMC0AddressPRG0 + m.bankAddr1)
+	default:
+		offset = int(address - MMC0AddressPRG1 + m.bankAddr2)
+	}
+	return offset, offset < len(m.rom.PRG)
+}
+
+func (m *mmc0) CHROffset(address uint16) (int, bool) {
+	return int(address), address < MMC0AddressVRAM_Limit && m.rom.Header.CHRROMSize > 0 && int(address) < len(m.rom.CHR)
+}
+
 func (m *mmc0) Set(address uint16, value byte) {
 	switch {
 	case address < MMC0AddressVRAM_Limit:
 		m.rom.SetCHR(address, value)
 	case address < MMC0AddressBatteryRAM:
 	case address < MMC0AddressPRG0:
+		m.rom.SetPRGRAM(address-MMC0AddressBatteryRAM, value)
 	case address < MMC0AddressPRG1:
 		m.rom.SetPRG(address-MMC0AddressPRG0+m.bankAddr1, value)
 	default:
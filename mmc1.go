@@ -18,11 +18,26 @@ func NewMMC1(rom *rom) mmc {
 }
 
 func (m *mmc1) Get(address uint16) byte {
+	switch {
+	case address < MMC1AddressOptionalPRG:
+	case address < MMC1AddressPRG0:
+		return m.rom.GetPRGRAM(address - MMC1AddressOptionalPRG)
+	}
 	// TODO: implement here
 	return 0
 }
 
+// Peek is Get, which has no side effects.
+func (m *mmc1) Peek(address uint16) byte {
+	return m.Get(address)
+}
+
 func (m *mmc1) Set(address uint16, value byte) {
+	switch {
+	case address < MMC1AddressOptionalPRG:
+	case address < MMC1AddressPRG0:
+		m.rom.SetPRGRAM(address-MMC1AddressOptionalPRG, value)
+	}
 	// TODO: implement here
 }
 
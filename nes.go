@@ -9,14 +9,37 @@ type NES struct {
 	PPUBus bus
 	CPUBus bus
 
+	Controllers [2]Controller
+
+	// CDL logs ROM usage when set with SetCDL.
+	CDL *CDL
+	// Watches is updated at the end of every frame, if set.
+	Watches *WatchList
+
 	vram [0x2000]byte
 	wram [0x0800]byte
+
+	dma     *dma
+	irq     irqSource
+	clocked clocked
+
+	// PPU dots owed to the CPU, in fifths
+	dots     int
+	dotsPer5 int
+
+	romFile string
+	config  Config
+
+	savePath string
+	saved    []byte
 }
 
-func NewNES(file string, renderer Renderer) (*NES, error) {
-	n := &NES{}
-	r := &rom{}
-	err := r.Load(file)
+func NewNES(file string, renderer Renderer, config Config) (*NES, error) {
+	n := &NES{
+		romFile: file,
+		config:  config,
+	}
+	r, err := LoadROM(file, config)
 	if err != nil {
 		return nil, err
 	}
@@ -25,11 +48,15 @@ func NewNES(file string, renderer Renderer) (*NES, error) {
 	n.APU = apu
 	mmc := NewMMC(r.Header.MapperNum, r)
 	n.MMC = mmc
-	ppuBus := NewPPUBus(n.vram[:], mmc)
+	ppuBus := NewPPUBus(n.vram[:], mmc, r.Header.Mirroring)
+	n.PPUBus = ppuBus
 	dma := &dma{}
-	ppu := NewPPU(ppuBus, dma, renderer)
+	n.dma = dma
+	n.dotsPer5 = n.Timing().PPUDotsPer5Cycles()
+	ppu := NewPPU(ppuBus, dma, renderer, n.Timing())
 	n.PPU = ppu
-	cpuBus := NewCPUBus(n.wram[:], ppu, apu, mmc)
+	cpuBus := NewCPUBus(n.wram[:], ppu, apu, mmc, &n.Controllers)
+	n.CPUBus = cpuBus
 	dma.bus = cpuBus
 	n.CPU = &cpu{
 		MMC: n.MMC,
@@ -37,15 +64,66 @@ func NewNES(file string, renderer Renderer) (*NES, error) {
 		APU: n.APU,
 		bus: cpuBus,
 	}
+	n.irq, _ = mmc.(irqSource)
+	n.clocked, _ = mmc.(clocked)
+
+	_, hasSaveData := mmc.(saveDataHolder)
+	if r.Header.Battery || hasSaveData {
+		archive, _ := splitArchivePath(file)
+		if err := n.loadSave(SavePath(archive, config.SaveDir)); err != nil {
+			return nil, err
+		}
+	}
 	return n, nil
 }
 
-func (n *NES) Tick() {
-	n.CPU.Tick()
-	n.PPU.Tick()
-	n.PPU.Tick()
-	n.PPU.Tick()
-	//time.Sleep(1 * time.Millisecond)
+// Tick executes one CPU instruction, runs the PPU and the mapper for the
+// cycles it took and returns that number of cycles.
+func (n *NES) Tick() int {
+	cycles := n.CPU.Tick()
+	stall := n.dma.Stall()
+	if n.CPU.profiler != nil {
+		n.CPU.profiler.charge(stall)
+	}
+	cycles += stall
+	n.dots += cycles * n.dotsPer5
+	frame := n.PPU.Frame
+	for ; n.dots >= 5; n.dots -= 5 {
+		n.PPU.Tick()
+	}
+	if n.Watches != nil && n.PPU.Frame != frame {
+		n.Watches.Update(n)
+	}
+	if n.clocked != nil {
+		for i := 0; i < cycles; i++ {
+			n.clocked.Clock()
+		}
+	}
+	if n.irq != nil && n.irq.IRQ() {
+		n.CPU.TriggerIRQ()
+	}
+	return cycles
+}
+
+// RunFrame runs the machine until the PPU finishes the current frame.
+func (n *NES) RunFrame() {
+	frame := n.PPU.Frame
+	for n.PPU.Frame == frame {
+		n.Tick()
+	}
+}
+
+// PRGOffset returns the PRG-ROM offset mapped at a CPU address, or -1
+// when it is not ROM or the mapper cannot tell.
+func (n *NES) PRGOffset(addr uint16) int {
+	return prgOffset(n.MMC, addr)
+}
+
+// SwitchDiskSide flips the disk of a Famicom Disk System game.
+func (n *NES) SwitchDiskSide() {
+	if f, ok := n.MMC.(*fds); ok {
+		f.SwitchSide()
+	}
 }
 
 func (n *NES) PowerOn() {
@@ -57,3 +135,12 @@ func (n *NES) Reset() {
 	n.CPU.Reset()
 	n.PPU.Reset()
 }
+
+// Timing returns the region the cartridge runs in. Multi-region
+// cartridges are run as NTSC.
+func (n *NES) Timing() Timing {
+	if n.ROM.Header.Timing == TimingMulti {
+		return TimingNTSC
+	}
+	return n.ROM.Header.Timing
+}
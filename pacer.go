@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+)
+
+// pacerMaxLag is how far behind the pacer may fall before it gives up
+// catching up, e.g. after the window was dragged or the host stalled.
+const pacerMaxLag = 5
+
+// Pacer sleeps between frames so the game runs at the console's frame
+// rate. Deadlines are absolute, so sleep overshoot on one frame is taken
+// back on the next instead of accumulating as drift.
+type Pacer struct {
+	period time.Duration
+	next   time.Time
+
+	// Speed scales the frame rate: 2 is fast-forward at twice the
+	// speed, 0.5 is slow motion at half.
+	Speed float64
+}
+
+func NewPacer(rate float64) *Pacer {
+	return &Pacer{
+		period: time.Duration(float64(time.Second) / rate),
+		Speed:  1,
+	}
+}
+
+// Wait sleeps until the next frame is due.
+func (p *Pacer) Wait() {
+	now := time.Now()
+	if p.next.IsZero() {
+		p.next = now
+	}
+
+	period := time.Duration(float64(p.period) / p.Speed)
+	p.next = p.next.Add(period)
+
+	if d := p.next.Sub(now); d > 0 {
+		time.Sleep(d)
+	} else if -d > pacerMaxLag*period {
+		p.next = now
+	}
+}
+
+// Reset forgets the schedule, e.g. after a pause.
+func (p *Pacer) Reset() {
+	p.next = time.Time{}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var patchExtensions = []string{".ips", ".ups", ".bps"}
+
+var errPatchTruncated = errors.New("patch is truncated")
+
+// FindPatch looks for a patch next to romFile with the same base name.
+// It returns an empty string when there is none.
+func FindPatch(romFile string) string {
+	base := strings.TrimSuffix(romFile, filepath.Ext(romFile))
+	if strings.ToLower(filepath.Ext(romFile)) == ".gz" {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	for _, ext := range patchExtensions {
+		for _, e := range []string{ext, strings.ToUpper(ext)} {
+			if _, err := os.Stat(base + e); err == nil {
+				return base + e
+			}
+		}
+	}
+	return ""
+}
+
+// ApplyPatchFile applies the IPS, UPS or BPS patch at file to data and
+// returns the patched image. The format is detected by its magic.
+func ApplyPatchFile(file string, data []byte) ([]byte, error) {
+	patch, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("applying patch %s\n", file)
+	res, err := ApplyPatch(patch, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return res, nil
+}
+
+func ApplyPatch(patch, data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(patch, []byte("PATCH")):
+		return applyIPS(patch, data)
+	case bytes.HasPrefix(patch, []byte("UPS1")):
+		return applyUPS(patch, data)
+	case bytes.HasPrefix(patch, []byte("BPS1")):
+		return applyBPS(patch, data)
+	}
+	return nil, errors.New("unknown patch format")
+}
+
+func applyIPS(patch, data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	p := patch[5:]
+	for {
+		if len(p) < 3 {
+			return nil, errPatchTruncated
+		}
+		if string(p[:3]) == "EOF" {
+			p = p[3:]
+			break
+		}
+		if len(p) < 5 {
+			return nil, errPatchTruncated
+		}
+		offset := int(p[0])<<16 | int(p[1])<<8 | int(p[2])
+		size := int(p[3])<<8 | int(p[4])
+		p = p[5:]
+
+		var chunk []byte
+		if size == 0 {
+			// RLE record
+			if len(p) < 3 {
+				return nil, errPatchTruncated
+			}
+			size = int(p[0])<<8 | int(p[1])
+			chunk = bytes.Repeat(p[2:3], size)
+			p = p[3:]
+		} else {
+			if len(p) < size {
+				return nil, errPatchTruncated
+			}
+			chunk = p[:size]
+			p = p[size:]
+		}
+
+		if offset+size > len(out) {
+			out = append(out, make([]byte, offset+size-len(out))...)
+		}
+		copy(out[offset:], chunk)
+	}
+
+	// optional truncation extension
+	if len(p) >= 3 {
+		size := int(p[0])<<16 | int(p[1])<<8 | int(p[2])
+		if size < len(out) {
+			out = out[:size]
+		}
+	}
+
+	return out, nil
+}
+
+// readVarint decodes the variable-length integers used by UPS and BPS.
+func readVarint(p []byte) (uint64, []byte, error) {
+	var data uint64
+	shift := uint64(1)
+	for {
+		if len(p) == 0 {
+			return 0, nil, errPatchTruncated
+		}
+		x := p[0]
+		p = p[1:]
+		data += uint64(x&0x7F) * shift
+		if x&0x80 != 0 {
+			break
+		}
+		shift <<= 7
+		data += shift
+	}
+	return data, p, nil
+}
+
+// verifyPatchFooter checks the three CRC32s shared by UPS and BPS
+// (source, target, patch) and returns the patch body without them.
+func verifyPatchFooter(patch, data []byte) ([]byte, uint32, error) {
+	if len(patch) < 12 {
+		return nil, 0, errPatchTruncated
+	}
+	footer := patch[len(patch)-12:]
+	sourceCRC := binary.LittleEndian.Uint32(footer[0:])
+	targetCRC := binary.LittleEndian.Uint32(footer[4:])
+	patchCRC := binary.LittleEndian.Uint32(footer[8:])
+
+	if got := crc32.ChecksumIEEE(patch[:len(patch)-4]); got != patchCRC {
+		return nil, 0, &ChecksumError{"patch", patchCRC, got}
+	}
+	if got := crc32.ChecksumIEEE(data); got != sourceCRC {
+		return nil, 0, &ChecksumError{"source ROM", sourceCRC, got}
+	}
+	return patch[:len(patch)-12], targetCRC, nil
+}
+
+// maxPatchTarget bounds the size a patch may declare for the patched ROM,
+// well above any real cartridge.
+const maxPatchTarget = 64 << 20
+
+func applyUPS(patch, data []byte) ([]byte, error) {
+	body, targetCRC, err := verifyPatchFooter(patch, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) < 4 {
+		return nil, errPatchTruncated
+	}
+	p := body[4:]
+	sourceSize, p, err := readVarint(p)
+	if err != nil {
+		return nil, err
+	}
+	targetSize, p, err := readVarint(p)
+	if err != nil {
+		return nil, err
+	}
+	if sourceSize != uint64(len(data)) {
+		return nil, fmt.Errorf("source size mismatch: want %d, got %d", sourceSize, len(data))
+	}
+	if targetSize > maxPatchTarget {
+		return nil, fmt.Errorf("target size %d exceeds %d bytes", targetSize, maxPatchTarget)
+	}
+
+	out := make([]byte, targetSize)
+	copy(out, data)
+
+	offset := uint64(0)
+	for len(p) > 0 {
+		var skip uint64
+		skip, p, err = readVarint(p)
+		if err != nil {
+			return nil, err
+		}
+		offset += skip
+		for {
+			if len(p) == 0 {
+				return nil, errPatchTruncated
+			}
+			x := p[0]
+			p = p[1:]
+			if x == 0 {
+				break
+			}
+			if offset < targetSize {
+				out[offset] ^= x
+			}
+			offset++
+		}
+		offset++
+	}
+
+	if got := crc32.ChecksumIEEE(out); got != targetCRC {
+		return nil, &ChecksumError{"patched ROM", targetCRC, got}
+	}
+	return out, nil
+}
+
+// BPS actions
+const (
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+func applyBPS(patch, data []byte) ([]byte, error) {
+	body, targetCRC, err := verifyPatchFooter(patch, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) < 4 {
+		return nil, errPatchTruncated
+	}
+	p := body[4:]
+	sourceSize, p, err := readVarint(p)
+	if err != nil {
+		return nil, err
+	}
+	targetSize, p, err := readVarint(p)
+	if err != nil {
+		return nil, err
+	}
+	metadataSize, p, err := readVarint(p)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(p)) < metadataSize {
+		return nil, errPatchTruncated
+	}
+	p = p[metadataSize:]
+	if sourceSize != uint64(len(data)) {
+		return nil, fmt.Errorf("source size mismatch: want %d, got %d", sourceSize, len(data))
+	}
+	if targetSize > maxPatchTarget {
+		return nil, fmt.Errorf("target size %d exceeds %d bytes", targetSize, maxPatchTarget)
+	}
+
+	out := make([]byte, 0, targetSize)
+	var sourceRel, targetRel int64
+
+	readOffset := func(rel int64) (int64, error) {
+		var v uint64
+		v, p, err = readVarint(p)
+		if err != nil {
+			return 0, err
+		}
+		delta := int64(v >> 1)
+		if v&1 != 0 {
+			delta = -delta
+		}
+		return rel + delta, nil
+	}
+
+	for len(p) > 0 {
+		var v uint64
+		v, p, err = readVarint(p)
+		if err != nil {
+			return nil, err
+		}
+		length := int64(v>>2) + 1
+		if int64(len(out))+length > int64(targetSize) {
+			return nil, fmt.Errorf("patch writes past the target size of %d bytes", targetSize)
+		}
+
+		switch v & 3 {
+		case bpsSourceRead:
+			start := int64(len(out))
+			if start+length > int64(len(data)) {
+				return nil, errors.New("source read out of range")
+			}
+			out = append(out, data[start:start+length]...)
+		case bpsTargetRead:
+			if int64(len(p)) < length {
+				return nil, errPatchTruncated
+			}
+			out = append(out, p[:length]...)
+			p = p[length:]
+		case bpsSourceCopy:
+			if sourceRel, err = readOffset(sourceRel); err != nil {
+				return nil, err
+			}
+			if sourceRel < 0 || sourceRel+length > int64(len(data)) {
+				return nil, errors.New("source copy out of range")
+			}
+			out = append(out, data[sourceRel:sourceRel+length]...)
+			sourceRel += length
+		case bpsTargetCopy:
+			if targetRel, err = readOffset(targetRel); err != nil {
+				return nil, err
+			}
+			if targetRel < 0 || targetRel >= int64(len(out)) {
+				return nil, errors.New("target copy out of range")
+			}
+			// copied byte by byte since the ranges may overlap
+			for i := int64(0); i < length; i++ {
+				out = append(out, out[targetRel])
+				targetRel++
+			}
+		}
+	}
+
+	if uint64(len(out)) != targetSize {
+		return nil, fmt.Errorf("target size mismatch: want %d, got %d", targetSize, len(out))
+	}
+	if got := crc32.ChecksumIEEE(out); got != targetCRC {
+		return nil, &ChecksumError{"patched ROM", targetCRC, got}
+	}
+	return out, nil
+}
+
+// MakeIPS returns an IPS patch that turns orig into modified, which must
+// be the same size and smaller than 16MB.
+func MakeIPS(orig, modified []byte) []byte {
+	res := []byte("PATCH")
+	for i := 0; i < len(modified); {
+		if i < len(orig) && orig[i] == modified[i] {
+			i++
+			continue
+		}
+		start := i
+		// "EOF" as an offset would end the patch early
+		if start == 0x454F46 {
+			start--
+		}
+		for i < len(modified) && i-start < 0xFFFF && (i >= len(orig) || orig[i] != modified[i]) {
+			i++
+		}
+		res = append(res, byte(start>>16), byte(start>>8), byte(start))
+		res = append(res, byte((i-start)>>8), byte(i-start))
+		res = append(res, modified[start:i]...)
+	}
+	return append(res, "EOF"...)
+}
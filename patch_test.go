@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// appendVarint encodes v the way readVarint decodes it.
+func appendVarint(b []byte, v uint64) []byte {
+	for {
+		x := byte(v & 0x7F)
+		v >>= 7
+		if v == 0 {
+			return append(b, 0x80|x)
+		}
+		b = append(b, x)
+		v--
+	}
+}
+
+// withFooter appends the source, target and patch CRC32s of UPS and BPS.
+func withFooter(body, source, target []byte) []byte {
+	var crc [4]byte
+	p := append([]byte{}, body...)
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(source))
+	p = append(p, crc[:]...)
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(target))
+	p = append(p, crc[:]...)
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(p))
+	return append(p, crc[:]...)
+}
+
+func bpsHeader(source, target int) []byte {
+	p := []byte("BPS1")
+	p = appendVarint(p, uint64(source))
+	p = appendVarint(p, uint64(target))
+	return appendVarint(p, 0)
+}
+
+func bpsCommand(p []byte, action int, length uint64) []byte {
+	return appendVarint(p, (length-1)<<2|uint64(action))
+}
+
+func TestApplyPatch(t *testing.T) {
+	source := []byte{1, 2, 3, 4}
+	target := []byte{1, 9, 3, 4}
+	grown := []byte{1, 2, 3, 4, 5, 5, 5}
+
+	ups := appendVarint(appendVarint([]byte("UPS1"), 4), 4)
+	ups = append(appendVarint(ups, 1), 2^9, 0)
+
+	bps := bpsCommand(bpsHeader(4, 4), bpsSourceRead, 1)
+	bps = append(bpsCommand(bps, bpsTargetRead, 1), 9)
+	bps = bpsCommand(bps, bpsSourceRead, 2)
+
+	// 2^40 bytes of target copy in a 4 byte target
+	huge := append(bpsCommand(bpsHeader(4, 4), bpsTargetRead, 1), 1)
+	huge = appendVarint(bpsCommand(huge, bpsTargetCopy, 1<<40), 0)
+	// source reads past the target size, each within the source
+	reads := bpsHeader(4, 4)
+	for i := 0; i < 4; i++ {
+		reads = bpsCommand(reads, bpsSourceRead, 4)
+	}
+
+	corrupt := withFooter(bps, source, target)
+	corrupt[len(corrupt)-1] ^= 0xFF
+
+	tests := []struct {
+		name   string
+		patch  []byte
+		source []byte
+		want   []byte
+		fails  bool
+	}{
+		{"IPS", []byte("PATCH\x00\x00\x01\x00\x01\x09EOF"), source, target, false},
+		{"IPS RLE", []byte("PATCH\x00\x00\x04\x00\x00\x00\x03\x05EOF"), source, grown, false},
+		{"IPS truncation", []byte("PATCHEOF\x00\x00\x02"), source, source[:2], false},
+		{"IPS truncated record", []byte("PATCH\x00\x00\x01\x00\x05\x09"), source, nil, true},
+		{"UPS", withFooter(ups, source, target), source, target, false},
+		{"UPS wrong source", withFooter(ups, source, target), target, nil, true},
+		{"UPS target CRC", withFooter(ups, source, source), source, nil, true},
+		{"UPS truncated", withFooter(ups, source, target)[:10], source, nil, true},
+		{"BPS", withFooter(bps, source, target), source, target, false},
+		{"BPS patch CRC", corrupt, source, nil, true},
+		{"BPS target CRC", withFooter(bps, source, source), source, nil, true},
+		{"BPS truncated", withFooter(bps[:len(bps)-1], source, target), source, nil, true},
+		{"BPS long target copy", withFooter(huge, source, target), source, nil, true},
+		{"BPS long source reads", withFooter(reads, source, source), source, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ApplyPatch(tt.patch, tt.source)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % X, want % X", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPatchChecksumError(t *testing.T) {
+	source := []byte{1, 2, 3, 4}
+	bps := bpsCommand(bpsHeader(4, 4), bpsSourceRead, 4)
+	_, err := ApplyPatch(withFooter(bps, source, []byte{0}), source)
+	if e, ok := err.(*ChecksumError); !ok || e.What != "patched ROM" {
+		t.Errorf("got %v, want a ChecksumError for the patched ROM", err)
+	}
+}
@@ -0,0 +1,220 @@
+//go:build !headless
+// +build !headless
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"log"
+	"time"
+
+	"github.com/go-gl/gl/v2.1/gl"
+	"github.com/go-gl/glfw/v3.2/glfw"
+)
+
+// play runs a ROM in a window until it is closed.
+func play(file string, config Config, runnerConfig RunnerConfig) error {
+	if err := glfw.Init(); err != nil {
+		return err
+	}
+	defer glfw.Terminate()
+
+	glfw.WindowHint(glfw.Resizable, glfw.True)
+	glfw.WindowHint(glfw.ContextVersionMajor, 2)
+	glfw.WindowHint(glfw.ContextVersionMinor, 1)
+
+	window, err := glfw.CreateWindow(300, 300, "nes", nil, nil)
+	if err != nil {
+		return err
+	}
+	window.MakeContextCurrent()
+	// frames are paced by the emulator, not by vsync
+	glfw.SwapInterval(0)
+
+	if err := gl.Init(); err != nil {
+		return err
+	}
+	gl.Enable(gl.TEXTURE_2D)
+
+	r := NewGLRenderer(window)
+	frames := NewTripleBuffer()
+
+	nes, err := NewNES(file, frames, config)
+	if err != nil {
+		return err
+	}
+
+	runner := NewRunner(nes, runnerConfig)
+	viewers := newPPUViewers(runner)
+	defer viewers.Close()
+
+	window.SetKeyCallback(func(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
+		if action != glfw.Press {
+			return
+		}
+		switch key {
+		case glfw.KeyF4:
+			runner.SwitchDiskSide()
+		case glfw.KeyF5:
+			runner.SaveState()
+		case glfw.KeyF7:
+			runner.LoadState()
+		case glfw.Key0, glfw.Key1, glfw.Key2, glfw.Key3, glfw.Key4,
+			glfw.Key5, glfw.Key6, glfw.Key7, glfw.Key8, glfw.Key9:
+			runner.SelectSlot(int(key - glfw.Key0))
+		case glfw.KeyP:
+			runner.TogglePause()
+		case glfw.KeyN:
+			runner.Advance()
+		case glfw.KeyL:
+			runner.ToggleSlowMotion()
+		case glfw.KeyF9:
+			viewers.Toggle()
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runner.Run(ctx)
+	}()
+
+	for !window.ShouldClose() {
+		select {
+		case <-frames.Ready():
+		case <-time.After(inputPollInterval):
+		}
+
+		glfw.PollEvents()
+		runner.SetInput(readInput(window))
+
+		if img, fresh := frames.Frame(); fresh {
+			r.Present(img)
+			viewers.Update()
+		}
+	}
+
+	cancel()
+	return <-done
+}
+
+// inputPollInterval bounds how long input goes unpolled while no frames
+// arrive, e.g. when paused.
+const inputPollInterval = 10 * time.Millisecond
+
+var buttonKeys = [8]glfw.Key{
+	glfw.KeyZ,          // A
+	glfw.KeyX,          // B
+	glfw.KeyRightShift, // Select
+	glfw.KeyEnter,      // Start
+	glfw.KeyUp,
+	glfw.KeyDown,
+	glfw.KeyLeft,
+	glfw.KeyRight,
+}
+
+func readInput(window *glfw.Window) Input {
+	var in Input
+	for i, key := range buttonKeys {
+		if window.GetKey(key) == glfw.Press {
+			in.Buttons[0] |= 1 << uint(i)
+		}
+	}
+	in.FastForward = window.GetKey(glfw.KeyTab) == glfw.Press
+	in.Rewind = window.GetKey(glfw.KeyBackspace) == glfw.Press
+	return in
+}
+
+// ppuViews are the windows toggled with F9.
+var ppuViews = []struct {
+	title         string
+	width, height int
+	render        func(p *ppu) image.Image
+}{
+	{"pattern tables", 256, 128, func(p *ppu) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, 256, 128))
+		draw.Draw(img, image.Rect(0, 0, 128, 128), p.PatternTable(0, 0), image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(128, 0, 256, 128), p.PatternTable(1, 4), image.Point{}, draw.Src)
+		return img
+	}},
+	{"nametables", 512, 480, (*ppu).NameTables},
+	{"sprites", 64, 128, (*ppu).SpriteTiles},
+	{"palettes", 256, 32, (*ppu).Palettes},
+}
+
+// ppuViewers shows the PPU views in their own windows. The images are
+// rendered on the emulation goroutine and drawn on the display one.
+type ppuViewers struct {
+	runner  *Runner
+	show    bool
+	windows []*GLViewer
+	images  chan []*image.RGBA
+	pending bool
+}
+
+func newPPUViewers(runner *Runner) *ppuViewers {
+	return &ppuViewers{
+		runner: runner,
+		images: make(chan []*image.RGBA, 1),
+	}
+}
+
+func (v *ppuViewers) Toggle() {
+	v.show = !v.show
+}
+
+// Update opens or closes the windows as toggled, and draws the views of
+// the latest frame.
+func (v *ppuViewers) Update() {
+	for _, w := range v.windows {
+		if w.ShouldClose() {
+			v.show = false
+		}
+	}
+	if !v.show {
+		v.Close()
+		return
+	}
+	if v.windows == nil {
+		for _, view := range ppuViews {
+			w, err := NewGLViewer("nes: "+view.title, view.width*2, view.height*2)
+			if err != nil {
+				log.Println(err)
+				v.show = false
+				v.Close()
+				return
+			}
+			v.windows = append(v.windows, w)
+		}
+	}
+
+	select {
+	case images := <-v.images:
+		for i, img := range images {
+			v.windows[i].Show(img)
+		}
+		v.pending = false
+	default:
+	}
+	if !v.pending {
+		v.pending = true
+		v.runner.Do(func(r *Runner) {
+			images := make([]*image.RGBA, len(ppuViews))
+			for i, view := range ppuViews {
+				img := view.render(r.nes.PPU)
+				images[i] = image.NewRGBA(img.Bounds())
+				draw.Draw(images[i], img.Bounds(), img, img.Bounds().Min, draw.Src)
+			}
+			v.images <- images
+		})
+	}
+}
+
+func (v *ppuViewers) Close() {
+	for _, w := range v.windows {
+		w.Destroy()
+	}
+	v.windows = nil
+}
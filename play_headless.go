@@ -0,0 +1,12 @@
+//go:build headless
+// +build headless
+
+package main
+
+import (
+	"errors"
+)
+
+func play(file string, config Config, runnerConfig RunnerConfig) error {
+	return errors.New("built without a display (headless tag); use nes run -headless")
+}
@@ -73,8 +73,13 @@ type ppu struct {
 	vblank        bool
 	spriteZeroHit bool
 
-	Cycle int
-	Line  int
+	Cycle     int
+	Line      int
+	Frame     int
+	scanlines int
+
+	// the last values written to PPUSCROLL
+	scrollX, scrollY byte
 
 	oam [0x100]byte
 	bus bus
@@ -83,12 +88,13 @@ type ppu struct {
 	renderer Renderer
 }
 
-func NewPPU(bus bus, dma *dma, renderer Renderer) *ppu {
+func NewPPU(bus bus, dma *dma, renderer Renderer, timing Timing) *ppu {
 	return &ppu{
-		buffer:   make([]byte, 0, 2),
-		bus:      bus,
-		dma:      dma,
-		renderer: renderer,
+		buffer:    make([]byte, 0, 2),
+		bus:       bus,
+		dma:       dma,
+		renderer:  renderer,
+		scanlines: timing.Scanlines(),
 	}
 }
 
@@ -103,9 +109,10 @@ func (p *ppu) Tick() {
 	if p.Cycle > PPUWidth {
 		p.Cycle = 0
 		p.Line++
-		if p.Line > PPUHeight {
+		if p.Line >= p.scanlines {
 			p.vblank = false
 			p.Line = 0
+			p.Frame++
 			p.renderer.Render()
 		} else if p.Line > PPUVisibleHeight {
 			p.vblank = true
@@ -243,6 +250,16 @@ func (p *ppu) GetData() byte {
 	return p.bus.Get(p.getAddr())
 }
 
+// PeekData returns what reading PPUDATA would, without reporting the
+// access.
+func (p *ppu) PeekData() byte {
+	if len(p.buffer) < 2 {
+		// no address written yet
+		return 0
+	}
+	return p.bus.Peek(p.getAddr())
+}
+
 func (p *ppu) SetData(value byte) {
 	log.Printf("set data(%x)", value)
 	addr := p.getAddr()
@@ -256,6 +273,15 @@ func (p *ppu) SetData(value byte) {
 }
 
 func (p *ppu) GetStatus() byte {
+	val := p.PeekStatus()
+	p.buffer = p.buffer[:]
+	p.vblank = false
+	return val
+}
+
+// PeekStatus returns what reading PPUSTATUS would, without clearing
+// vblank.
+func (p *ppu) PeekStatus() byte {
 	val := byte(0)
 	if p.vblank {
 		val |= 1 << statusVBlank
@@ -263,8 +289,6 @@ func (p *ppu) GetStatus() byte {
 	if p.spriteZeroHit {
 		val |= 1 << statusSpriteZeroHit
 	}
-	p.buffer = p.buffer[:]
-	p.vblank = false
 	return val
 }
 
@@ -272,6 +296,10 @@ func (p *ppu) GetOAM() byte {
 	return 0
 }
 
+func (p *ppu) PeekOAM() byte {
+	return p.GetOAM()
+}
+
 func (p *ppu) SetOAM(v byte) {
 }
 
@@ -280,6 +308,11 @@ func (p *ppu) SetScroll(v byte) {
 		p.buffer = p.buffer[:0]
 	}
 	p.buffer = append(p.buffer, v)
+	if len(p.buffer) == 1 {
+		p.scrollX = v
+	} else {
+		p.scrollY = v
+	}
 }
 
 func (p *ppu) SetAddr(v byte) {
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// PPUCTRL bits the viewers need
+const (
+	ctrlMaskNameTable   = 0x03
+	ctrlMaskSpriteTable = 0x08
+	ctrlMaskBGTable     = 0x10
+	ctrlMaskSpriteSize  = 0x20
+)
+
+// sprite attribute bits
+const (
+	spriteAttrPalette  = 0x03
+	spriteAttrPriority = 0x20
+	spriteAttrFlipH    = 0x40
+	spriteAttrFlipV    = 0x80
+)
+
+// scrollColor outlines the visible screen in the nametable view.
+var scrollColor = color.RGBA{0xFF, 0x00, 0xFF, 0xFF}
+
+// PaletteColors returns the four colors of a palette: 0-3 are the
+// background palettes, 4-7 the sprite palettes.
+func (p *ppu) PaletteColors(palette int) [4]color.RGBA {
+	var res [4]color.RGBA
+	for i := range res {
+		v := p.bus.Peek(PPUAddressPaletteBG + uint16(palette%8*4+i))
+		res[i] = colors[v&0x3F]
+	}
+	return res
+}
+
+// drawTile draws the 8x8 tile at addr on the pattern tables. Color 0 is
+// left untouched when transparent is set.
+func (p *ppu) drawTile(img *image.RGBA, x, y int, addr uint16, palette [4]color.RGBA, flipH, flipV, transparent bool) {
+	for row := 0; row < 8; row++ {
+		low := p.bus.Peek(addr + uint16(row))
+		high := p.bus.Peek(addr + uint16(row) + 8)
+		py := y + row
+		if flipV {
+			py = y + 7 - row
+		}
+		for col := 0; col < 8; col++ {
+			shift := uint(7 - col)
+			n := (high>>shift&1)<<1 | low>>shift&1
+			if n == 0 && transparent {
+				continue
+			}
+			px := x + col
+			if flipH {
+				px = x + 7 - col
+			}
+			img.SetRGBA(px, py, palette[n])
+		}
+	}
+}
+
+// PatternTable renders the 256 tiles of pattern table 0 or 1 as a
+// 128x128 image, colored with one of the 8 palettes.
+func (p *ppu) PatternTable(table, palette int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	colors := p.PaletteColors(palette)
+	base := uint16(table&1) * 0x1000
+	for tile := 0; tile < 256; tile++ {
+		p.drawTile(img, tile%16*8, tile/16*8, base+uint16(tile*16), colors, false, false, false)
+	}
+	return img
+}
+
+// NameTables renders the four nametables as a 512x480 image, with the
+// part that scrolling puts on screen outlined.
+func (p *ppu) NameTables() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 2*PPUVisibleWidth, 2*PPUVisibleHeight))
+	patterns := uint16(0)
+	if p.Ctrl&ctrlMaskBGTable != 0 {
+		patterns = 0x1000
+	}
+	var palettes [4][4]color.RGBA
+	for i := range palettes {
+		palettes[i] = p.PaletteColors(i)
+	}
+	for table := 0; table < 4; table++ {
+		base := PPUAddressNameTable0 + uint16(table)*PPUNameTableSize
+		left := table % 2 * PPUVisibleWidth
+		top := table / 2 * PPUVisibleHeight
+		for ty := 0; ty < 30; ty++ {
+			for tx := 0; tx < 32; tx++ {
+				tile := p.bus.Peek(base + uint16(ty*32+tx))
+				attr := p.bus.Peek(base + 0x3C0 + uint16(ty/4*8+tx/4))
+				shift := uint(ty&2<<1 | tx&2)
+				palette := palettes[attr>>shift&3]
+				p.drawTile(img, left+tx*8, top+ty*8, patterns+uint16(tile)*16, palette, false, false, false)
+			}
+		}
+	}
+
+	x0 := int(p.Ctrl&1)*PPUVisibleWidth + int(p.scrollX)
+	y0 := int(p.Ctrl>>1&1)*PPUVisibleHeight + int(p.scrollY)
+	set := func(x, y int) {
+		img.SetRGBA(x%(2*PPUVisibleWidth), y%(2*PPUVisibleHeight), scrollColor)
+	}
+	for x := 0; x < PPUVisibleWidth; x++ {
+		set(x0+x, y0)
+		set(x0+x, y0+PPUVisibleHeight-1)
+	}
+	for y := 0; y < PPUVisibleHeight; y++ {
+		set(x0, y0+y)
+		set(x0+PPUVisibleWidth-1, y0+y)
+	}
+	return img
+}
+
+// Sprite is an entry of OAM.
+type Sprite struct {
+	Index int
+	X, Y  int
+	Tile  byte
+	Attr  byte
+}
+
+func (s Sprite) Palette() int {
+	return int(s.Attr&spriteAttrPalette) + 4
+}
+
+// Behind reports whether the sprite is drawn behind the background.
+func (s Sprite) Behind() bool {
+	return s.Attr&spriteAttrPriority != 0
+}
+
+func (s Sprite) FlipH() bool {
+	return s.Attr&spriteAttrFlipH != 0
+}
+
+func (s Sprite) FlipV() bool {
+	return s.Attr&spriteAttrFlipV != 0
+}
+
+func (s Sprite) String() string {
+	flags := ""
+	if s.Behind() {
+		flags += " behind"
+	}
+	if s.FlipH() {
+		flags += " flip-h"
+	}
+	if s.FlipV() {
+		flags += " flip-v"
+	}
+	return fmt.Sprintf("%2d: x=%3d y=%3d tile=$%02X palette=%d%s", s.Index, s.X, s.Y, s.Tile, s.Palette(), flags)
+}
+
+// OAM returns the 64 sprites.
+func (p *ppu) OAM() []Sprite {
+	sprites := make([]Sprite, 64)
+	for i := range sprites {
+		sprites[i] = Sprite{
+			Index: i,
+			Y:     int(p.oam[i*4]),
+			Tile:  p.oam[i*4+1],
+			Attr:  p.oam[i*4+2],
+			X:     int(p.oam[i*4+3]),
+		}
+	}
+	return sprites
+}
+
+// SpriteTiles renders the 64 sprites in an 8x8 grid of 8x16 cells, with
+// their palettes and flipping applied. Transparent pixels are left clear.
+func (p *ppu) SpriteTiles() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 8*8, 8*16))
+	tall := p.Ctrl&ctrlMaskSpriteSize != 0
+	for _, s := range p.OAM() {
+		x, y := s.Index%8*8, s.Index/8*16
+		colors := p.PaletteColors(s.Palette())
+		if !tall {
+			base := uint16(0)
+			if p.Ctrl&ctrlMaskSpriteTable != 0 {
+				base = 0x1000
+			}
+			p.drawTile(img, x, y, base+uint16(s.Tile)*16, colors, s.FlipH(), s.FlipV(), true)
+			continue
+		}
+		// 8x16 sprites take the table from bit 0 of the tile number
+		top := uint16(s.Tile&1)*0x1000 + uint16(s.Tile&0xFE)*16
+		bottom := top + 16
+		if s.FlipV() {
+			top, bottom = bottom, top
+		}
+		p.drawTile(img, x, y, top, colors, s.FlipH(), s.FlipV(), true)
+		p.drawTile(img, x, y+8, bottom, colors, s.FlipH(), s.FlipV(), true)
+	}
+	return img
+}
+
+// Palettes renders the 32 entries of palette RAM as 16x16 swatches, the
+// background palettes on the top row and the sprite palettes below.
+func (p *ppu) Palettes() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16*16, 2*16))
+	for i := 0; i < 32; i++ {
+		c := colors[p.bus.Peek(PPUAddressPaletteBG+uint16(i))&0x3F]
+		x, y := i%16*16, i/16*16
+		for dy := 0; dy < 16; dy++ {
+			for dx := 0; dx < 16; dx++ {
+				img.SetRGBA(x+dx, y+dy, c)
+			}
+		}
+	}
+	return img
+}
+
+// WriteOAM lists the sprites that are on screen.
+func (p *ppu) WriteOAM(w io.Writer) {
+	for _, s := range p.OAM() {
+		// sprites are hidden by moving them below the screen
+		if s.Y >= 0xEF {
+			continue
+		}
+		fmt.Fprintln(w, s)
+	}
+}
+
+func writePNG(file string, img image.Image) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// DumpPPU writes the PPU viewers as PNG files, and the sprite list as
+// oam.txt, to dir.
+func (n *NES) DumpPPU(dir string, palette int) error {
+	images := []struct {
+		name string
+		img  image.Image
+	}{
+		{"screen.png", nil},
+		{"pattern0.png", n.PPU.PatternTable(0, palette)},
+		{"pattern1.png", n.PPU.PatternTable(1, palette)},
+		{"nametables.png", n.PPU.NameTables()},
+		{"sprites.png", n.PPU.SpriteTiles()},
+		{"palettes.png", n.PPU.Palettes()},
+	}
+	if fb, ok := n.PPU.renderer.(*FrameBuffer); ok {
+		images[0].img = fb.Image()
+	}
+	for _, i := range images {
+		if i.img == nil {
+			continue
+		}
+		if err := writePNG(filepath.Join(dir, i.name), i.img); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, "oam.txt"))
+	if err != nil {
+		return err
+	}
+	n.PPU.WriteOAM(f)
+	return f.Close()
+}
+
+// dumpPPUCommand runs a ROM headless and writes the PPU viewers.
+func dumpPPUCommand(args []string) error {
+	fs := flag.NewFlagSet("dump-ppu", flag.ExitOnError)
+	configFlags := NewConfigFlags(fs)
+	frame := fs.Int("frame", 60, "number of frames to run before dumping")
+	inputFile := fs.String("input", "", "input script (see nes run)")
+	palette := fs.Int("palette", 0, "palette for the pattern tables (0-3 background, 4-7 sprites)")
+	dir := fs.String("o", ".", "directory to write the images to")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: nes dump-ppu [flags] rom.nes")
+	}
+	if *palette < 0 || *palette > 7 {
+		return fmt.Errorf("palette %d out of range 0-7", *palette)
+	}
+
+	config, err := configFlags.Config()
+	if err != nil {
+		return err
+	}
+	var script InputScript
+	if *inputFile != "" {
+		if script, err = LoadInputScript(*inputFile); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+
+	nes, err := NewNES(fs.Arg(0), NewFrameBuffer(), config)
+	if err != nil {
+		return err
+	}
+	nes.PowerOn()
+	RunHeadless(nes, *frame, script)
+	return nes.DumpPPU(*dir, *palette)
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// what the CPU was doing, for frame budgets
+const (
+	contextMain = iota
+	contextNMI
+	contextIRQ
+	numContexts
+)
+
+var contextNames = [numContexts]string{"main", "NMI", "IRQ"}
+
+// Routine is a subroutine or interrupt handler, told apart by the PRG-ROM
+// offset of its entry so the same address in different banks is not
+// mixed up.
+type Routine struct {
+	Addr   uint16
+	Offset int
+	Name   string
+
+	Calls int64
+	// Self counts cycles spent in the routine itself, Total includes the
+	// routines it called.
+	Self  int64
+	Total int64
+}
+
+type routineKey struct {
+	addr   uint16
+	offset int
+}
+
+type profileNode struct {
+	routine  *Routine
+	parent   *profileNode
+	children map[*Routine]*profileNode
+	calls    int64
+	self     int64
+}
+
+func (n *profileNode) child(r *Routine) *profileNode {
+	c, ok := n.children[r]
+	if !ok {
+		c = &profileNode{routine: r, parent: n, children: map[*Routine]*profileNode{}}
+		n.children[r] = c
+	}
+	return c
+}
+
+type profileFrame struct {
+	node *profileNode
+	// the stack pointer right after entering; returning pops above it
+	s       byte
+	context int
+}
+
+// FrameBudget is where the cycles of one video frame went.
+type FrameBudget struct {
+	Frame  int
+	Cycles [numContexts]int64
+}
+
+func (b FrameBudget) Total() int64 {
+	var t int64
+	for _, c := range b.Cycles {
+		t += c
+	}
+	return t
+}
+
+// Profiler attributes CPU cycles to routines, following JSR, RTS, RTI
+// and interrupts to build a call tree.
+type Profiler struct {
+	nes *NES
+
+	// Symbols names routines, if set.
+	Symbols *Symbols
+
+	routines map[routineKey]*Routine
+	root     *profileNode
+	stack    []profileFrame
+
+	frame   FrameBudget
+	Budgets []FrameBudget
+}
+
+func NewProfiler(n *NES) *Profiler {
+	p := &Profiler{
+		nes:      n,
+		routines: map[routineKey]*Routine{},
+	}
+	main := p.routine(n.CPU.PC)
+	main.Name = "main"
+	p.root = &profileNode{routine: main, children: map[*Routine]*profileNode{}}
+	p.stack = []profileFrame{{node: p.root, s: 0xFF, context: contextMain}}
+	p.frame.Frame = n.PPU.Frame
+	return p
+}
+
+// SetProfiler starts profiling with p, or stops with nil.
+func (n *NES) SetProfiler(p *Profiler) {
+	n.CPU.profiler = p
+}
+
+func (p *Profiler) routine(addr uint16) *Routine {
+	key := routineKey{addr, p.nes.PRGOffset(addr)}
+	r, ok := p.routines[key]
+	if !ok {
+		r = &Routine{Addr: addr, Offset: key.offset}
+		p.routines[key] = r
+	}
+	return r
+}
+
+// name returns how r is shown in reports and exports.
+func (p *Profiler) name(r *Routine) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	if p.Symbols != nil {
+		if name := p.Symbols.Name(r.Addr, r.Offset); name != "" {
+			return name
+		}
+	}
+	// routines in switchable banks are told apart by their ROM offset
+	if r.Offset >= 0 && len(p.nes.ROM.PRG) > 0x8000 {
+		return fmt.Sprintf("$%04X@%05X", r.Addr, r.Offset)
+	}
+	return fmt.Sprintf("$%04X", r.Addr)
+}
+
+func (p *Profiler) top() *profileFrame {
+	return &p.stack[len(p.stack)-1]
+}
+
+func (p *Profiler) push(addr uint16, s byte, context int) {
+	top := p.top()
+	r := p.routine(addr)
+	node := top.node.child(r)
+	node.calls++
+	r.Calls++
+	p.stack = append(p.stack, profileFrame{node: node, s: s, context: context})
+}
+
+// charge attributes cycles to the running routine.
+func (p *Profiler) charge(cycles int) {
+	if frame := p.nes.PPU.Frame; frame != p.frame.Frame {
+		p.Budgets = append(p.Budgets, p.frame)
+		p.frame = FrameBudget{Frame: frame}
+	}
+	top := p.top()
+	top.node.self += int64(cycles)
+	p.frame.Cycles[top.context] += int64(cycles)
+}
+
+// instruction is called by the CPU after running the instruction at pc,
+// with the interrupt it took first, if any, and the stack pointer the
+// instruction started with.
+func (p *Profiler) instruction(c *cpu, entered int, pc uint16, s byte, opcode byte) {
+	switch entered {
+	case interruptNMI:
+		p.push(pc, s, contextNMI)
+	case interruptIRQ, interruptBRK:
+		p.push(pc, s, contextIRQ)
+	}
+
+	p.charge(c.cycles)
+
+	switch instruction_names[opcode] {
+	case "JSR":
+		p.push(c.PC, c.S, p.top().context)
+	case "RTS", "RTI":
+		for len(p.stack) > 1 && p.top().s < c.S {
+			p.stack = p.stack[:len(p.stack)-1]
+		}
+	}
+}
+
+// Routines returns every routine seen, with Self and Total filled in,
+// by descending self time.
+func (p *Profiler) Routines() []*Routine {
+	for _, r := range p.routines {
+		r.Self, r.Total = 0, 0
+	}
+	var walk func(n *profileNode, active map[*Routine]bool) int64
+	walk = func(n *profileNode, active map[*Routine]bool) int64 {
+		total := n.self
+		// a recursive routine is only counted once in its own total
+		outer := active[n.routine]
+		active[n.routine] = true
+		for _, c := range n.children {
+			total += walk(c, active)
+		}
+		active[n.routine] = outer
+		n.routine.Self += n.self
+		if !outer {
+			n.routine.Total += total
+		}
+		return total
+	}
+	walk(p.root, map[*Routine]bool{})
+
+	list := make([]*Routine, 0, len(p.routines))
+	for _, r := range p.routines {
+		if r.Total > 0 {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Self != list[j].Self {
+			return list[i].Self > list[j].Self
+		}
+		return list[i].Addr < list[j].Addr
+	})
+	return list
+}
+
+// Report writes the frame budgets and the top routines.
+func (p *Profiler) Report(w io.Writer, top int) {
+	budgets := p.Budgets
+	if len(budgets) > 0 {
+		var sum, max [numContexts]int64
+		var total int64
+		for _, b := range budgets {
+			for i, c := range b.Cycles {
+				sum[i] += c
+				if c > max[i] {
+					max[i] = c
+				}
+			}
+			total += b.Total()
+		}
+		frames := int64(len(budgets))
+		fmt.Fprintf(w, "%d frames, %d cycles per frame\n", frames, total/frames)
+		for i, name := range contextNames {
+			fmt.Fprintf(w, "  %-5s avg %6d (%5.1f%%)  max %6d\n", name, sum[i]/frames, percentOf(sum[i], total), max[i])
+		}
+		fmt.Fprintln(w)
+	}
+
+	routines := p.Routines()
+	var total int64
+	for _, r := range routines {
+		total += r.Self
+	}
+	fmt.Fprintf(w, "%-24s %8s %12s %7s %12s %7s\n", "routine", "calls", "self", "self%", "total", "total%")
+	for i, r := range routines {
+		if top > 0 && i >= top {
+			break
+		}
+		fmt.Fprintf(w, "%-24s %8d %12d %6.1f%% %12d %6.1f%%\n",
+			p.name(r), r.Calls, r.Self, percentOf(r.Self, total), r.Total, percentOf(r.Total, total))
+	}
+}
+
+func percentOf(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// WriteFolded writes the call tree in the folded stack format of
+// flamegraph.pl: one "caller;callee cycles" line per call path.
+func (p *Profiler) WriteFolded(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var walk func(n *profileNode, path string)
+	walk = func(n *profileNode, path string) {
+		name := strings.Replace(p.name(n.routine), ";", "_", -1)
+		if path != "" {
+			name = path + ";" + name
+		}
+		if n.self > 0 {
+			fmt.Fprintf(bw, "%s %d\n", name, n.self)
+		}
+		for _, c := range p.sortedChildren(n) {
+			walk(c, name)
+		}
+	}
+	walk(p.root, "")
+	return bw.Flush()
+}
+
+func (p *Profiler) sortedChildren(n *profileNode) []*profileNode {
+	children := make([]*profileNode, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, b := children[i].routine, children[j].routine
+		if a.Addr != b.Addr {
+			return a.Addr < b.Addr
+		}
+		return a.Offset < b.Offset
+	})
+	return children
+}
+
+// WritePprof writes the call tree as a gzipped pprof profile with a
+// sample per call path, valued in CPU cycles.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	var prof protoBuffer
+	index := map[string]int64{}
+	var table []string
+	str := func(s string) int64 {
+		if i, ok := index[s]; ok {
+			return i
+		}
+		index[s] = int64(len(table))
+		table = append(table, s)
+		return index[s]
+	}
+	str("")
+
+	valueType := func(field int, typ, unit string) {
+		var vt protoBuffer
+		vt.int(1, str(typ))
+		vt.int(2, str(unit))
+		prof.message(field, vt)
+	}
+	valueType(1, "calls", "count")
+	valueType(1, "cycles", "count")
+
+	ids := map[*Routine]uint64{}
+	for _, r := range p.sortedRoutines() {
+		id := uint64(len(ids) + 1)
+		ids[r] = id
+
+		var fn protoBuffer
+		fn.int(1, int64(id))
+		fn.int(2, str(p.name(r)))
+		fn.int(3, str(fmt.Sprintf("$%04X", r.Addr)))
+		var line SourceLine
+		if p.Symbols != nil {
+			line, _ = p.Symbols.Line(r.Offset)
+		}
+		fn.int(4, str(line.File))
+		fn.int(5, int64(line.Line))
+		prof.message(5, fn)
+
+		var ln protoBuffer
+		ln.int(1, int64(id))
+		ln.int(2, int64(line.Line))
+		var loc protoBuffer
+		loc.int(1, int64(id))
+		loc.int(3, int64(r.Addr))
+		loc.message(4, ln)
+		prof.message(4, loc)
+	}
+
+	var walk func(n *profileNode, stack []uint64)
+	walk = func(n *profileNode, stack []uint64) {
+		// pprof stacks start at the leaf
+		stack = append([]uint64{ids[n.routine]}, stack...)
+		if n.self > 0 || n.calls > 0 {
+			var sample protoBuffer
+			sample.packed(1, stack)
+			sample.packed(2, []uint64{uint64(n.calls), uint64(n.self)})
+			prof.message(2, sample)
+		}
+		for _, c := range p.sortedChildren(n) {
+			walk(c, stack)
+		}
+	}
+	walk(p.root, nil)
+
+	valueType(11, "cpu", "cycles")
+	prof.int(12, 1)
+	for _, s := range table {
+		prof.bytes(6, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(prof); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (p *Profiler) sortedRoutines() []*Routine {
+	list := make([]*Routine, 0, len(p.routines))
+	for _, r := range p.routines {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Addr != list[j].Addr {
+			return list[i].Addr < list[j].Addr
+		}
+		return list[i].Offset < list[j].Offset
+	})
+	return list
+}
+
+// protoBuffer encodes the few protocol buffer wire types pprof needs.
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *protoBuffer) int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(uint64(v))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *protoBuffer) message(field int, m protoBuffer) {
+	b.bytes(field, m)
+}
+
+func (b *protoBuffer) packed(field int, values []uint64) {
+	var data protoBuffer
+	for _, v := range values {
+		data.varint(v)
+	}
+	b.bytes(field, data)
+}
+
+// profileCommand runs a ROM headless under the profiler.
+func profileCommand(args []string) error {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	configFlags := NewConfigFlags(fs)
+	frames := fs.Int("frames", 600, "number of frames to run")
+	inputFile := fs.String("input", "", "input script (see nes run)")
+	symbolFiles := fs.String("symbols", "", "comma-separated .dbg, .mlb or .nl files (default: found next to the ROM)")
+	pprof := fs.String("pprof", "", "write a pprof profile to this file")
+	folded := fs.String("folded", "", "write folded stacks for flame graphs to this file")
+	top := fs.Int("top", 20, "number of routines to report")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: nes profile [flags] rom.nes")
+	}
+
+	config, err := configFlags.Config()
+	if err != nil {
+		return err
+	}
+	var script InputScript
+	if *inputFile != "" {
+		if script, err = LoadInputScript(*inputFile); err != nil {
+			return err
+		}
+	}
+
+	nes, err := NewNES(fs.Arg(0), NewFrameBuffer(), config)
+	if err != nil {
+		return err
+	}
+	nes.PowerOn()
+
+	p := NewProfiler(nes)
+	if p.Symbols, err = LoadSymbolFiles(splitList(*symbolFiles), fs.Arg(0)); err != nil {
+		return err
+	}
+	nes.SetProfiler(p)
+	RunHeadless(nes, *frames, script)
+	nes.SetProfiler(nil)
+
+	p.Report(os.Stdout, *top)
+
+	write := func(file string, f func(io.Writer) error) error {
+		out, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		if err := f(out); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	}
+	if *pprof != "" {
+		if err := write(*pprof, p.WritePprof); err != nil {
+			return err
+		}
+	}
+	if *folded != "" {
+		if err := write(*folded, p.WriteFolded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	DefaultRewindSeconds  = 10
+	DefaultRewindInterval = 1
+	// rewindKeyframeEvery is how many snapshots share a keyframe
+	rewindKeyframeEvery = 60
+)
+
+var ErrRewindEmpty = errors.New("nothing to rewind")
+
+// rewindEntry is a snapshot stored as the run-length encoded XOR of the
+// state against its keyframe. A keyframe entry has an empty delta.
+type rewindEntry struct {
+	keyframe []byte
+	delta    []byte
+}
+
+func (e rewindEntry) state() []byte {
+	res := make([]byte, len(e.keyframe))
+	copy(res, e.keyframe)
+	if e.delta != nil {
+		undelta(res, e.delta)
+	}
+	return res
+}
+
+// Rewind keeps a ring of snapshots taken every few frames, so the game
+// can be run backwards.
+type Rewind struct {
+	interval int
+	entries  []rewindEntry
+	head     int
+	count    int
+	frames   int
+	sinceKey int
+	keyframe []byte
+}
+
+// NewRewind creates a rewind buffer that reaches seconds back, taking a
+// snapshot every interval frames.
+func NewRewind(seconds float64, interval int, timing Timing) *Rewind {
+	if interval < 1 {
+		interval = 1
+	}
+	size := int(seconds * timing.FrameRate() / float64(interval))
+	if size < 1 {
+		size = 1
+	}
+	return &Rewind{
+		interval: interval,
+		entries:  make([]rewindEntry, size),
+	}
+}
+
+// Push is called once per frame and takes a snapshot every interval
+// frames.
+func (r *Rewind) Push(n *NES) error {
+	r.frames++
+	if r.frames < r.interval {
+		return nil
+	}
+	r.frames = 0
+
+	var buf bytes.Buffer
+	if err := n.SaveState(&buf); err != nil {
+		return err
+	}
+	state := buf.Bytes()
+
+	var e rewindEntry
+	if r.keyframe == nil || r.sinceKey >= rewindKeyframeEvery || len(state) != len(r.keyframe) {
+		r.keyframe = state
+		r.sinceKey = 0
+		e = rewindEntry{keyframe: state}
+	} else {
+		e = rewindEntry{keyframe: r.keyframe, delta: delta(r.keyframe, state)}
+	}
+	r.sinceKey++
+
+	r.entries[r.head] = e
+	r.head = (r.head + 1) % len(r.entries)
+	if r.count < len(r.entries) {
+		r.count++
+	}
+	return nil
+}
+
+// Step restores the latest snapshot and drops it, moving back interval
+// frames. The caller runs a frame afterwards to show it.
+func (r *Rewind) Step(n *NES) error {
+	if r.count == 0 {
+		return ErrRewindEmpty
+	}
+	r.head = (r.head - 1 + len(r.entries)) % len(r.entries)
+	r.count--
+	e := r.entries[r.head]
+	r.entries[r.head] = rewindEntry{}
+
+	// later snapshots must not use a keyframe that is gone from the ring
+	r.keyframe = nil
+	r.frames = 0
+
+	return n.LoadState(bytes.NewReader(e.state()))
+}
+
+// Len returns the number of snapshots held.
+func (r *Rewind) Len() int {
+	return r.count
+}
+
+// delta encodes state XOR base as runs: a uvarint count of unchanged
+// bytes, a uvarint count of changed bytes, then the changed bytes XORed.
+func delta(base, state []byte) []byte {
+	var res []byte
+	var tmp [10]byte
+	put := func(v int) {
+		n := binary.PutUvarint(tmp[:], uint64(v))
+		res = append(res, tmp[:n]...)
+	}
+	for i := 0; i < len(state); {
+		start := i
+		for i < len(state) && state[i] == base[i] {
+			i++
+		}
+		same := i - start
+		start = i
+		for i < len(state) && state[i] != base[i] {
+			i++
+		}
+		put(same)
+		put(i - start)
+		for j := start; j < i; j++ {
+			res = append(res, state[j]^base[j])
+		}
+	}
+	return res
+}
+
+// undelta applies a delta produced by delta to a copy of its base.
+func undelta(state, d []byte) {
+	pos := 0
+	for len(d) > 0 {
+		same, n := binary.Uvarint(d)
+		d = d[n:]
+		changed, n := binary.Uvarint(d)
+		d = d[n:]
+		pos += int(same)
+		for j := 0; j < int(changed) && len(d) > 0; j++ {
+			state[pos] ^= d[0]
+			d = d[1:]
+			pos++
+		}
+	}
+}
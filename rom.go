@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
@@ -10,103 +10,197 @@ import (
 
 type rom struct {
 	Header      Header
+	Board       string
 	Trainer     [512]byte
 	PRG         []byte
 	CHR         []byte
+	PRGRAM      []byte
 	PC10InstROM []byte
 	PC10PROM    []byte
+	MiscROM     []byte
+	Disk        [][]byte
 }
 
-type Header struct {
-	MapperNum int
+const (
+	PC10InstROMSize = 8 * 1024
+	PC10PROMSize    = 16 + 16 // data + CounterOut
+)
+
+// LoadROM reads a ROM image from file (unpacking archives), applies a
+// patch and checks the game database as set up in config.
+func LoadROM(file string, config Config) (*rom, error) {
+	data, _, err := ReadROMFile(file)
+	if err != nil {
+		return nil, err
+	}
+	archive, _ := splitArchivePath(file)
+	patch := config.PatchFile
+	if patch == "" {
+		patch = FindPatch(archive)
+	}
+	if patch != "" {
+		data, err = ApplyPatchFile(patch, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r := &rom{}
+	err = r.LoadBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if r.Header.MapperNum == MapperFDS {
+		if err := r.LoadFDSBIOS(config.FDSBIOS, archive); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	r.checkGameDB(config.DBPolicy)
+	return r, nil
 }
 
-// NES 2.0
-func (r *rom) Load(file string) error {
+func (r *rom) LoadFile(file string) error {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		return err
 	}
+	return r.LoadBytes(data)
+}
 
-	buf := bytes.NewReader(data)
+func (r *rom) Load(rd io.Reader) error {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	return r.LoadBytes(data)
+}
 
+// LoadBytes parses an iNES, NES 2.0 or UNIF image.
+func (r *rom) LoadBytes(data []byte) error {
 	log.Println("start loading...")
 
-	n, _ := buf.ReadByte()
-	e, _ := buf.ReadByte()
-	s, _ := buf.ReadByte()
-	f, _ := buf.ReadByte()
-
-	if !(0x4E == n &&
-		0x45 == e &&
-		0x53 == s &&
-		0x1A == f) {
-		return errors.New("unknown format")
+	if bytes.HasPrefix(data, []byte(UNIFMagic)) {
+		return r.loadUNIF(data)
+	}
+	if isFDSImage(data) {
+		return r.loadFDS(data)
 	}
+	return r.loadINES(data)
+}
 
-	prg_size, _ := buf.ReadByte()
-	chr_size, _ := buf.ReadByte()
+// NES 2.0
+func (r *rom) loadINES(data []byte) error {
+	buf := bytes.NewReader(data)
 
-	log.Printf("PRG: %d, CHR: %d\n", prg_size, chr_size)
+	var raw [HeaderSize]byte
+	if err := readSection(buf, "header", raw[:]); err != nil {
+		return err
+	}
 
-	flag1, _ := buf.ReadByte()
-	flag2, _ := buf.ReadByte()
+	if cleanHeader(&raw) {
+		log.Println("dirty iNES header detected, ignoring bytes 7-15")
+	}
 
-	prg_ram_size, _ := buf.ReadByte()
-	_ = prg_ram_size
+	header, err := ParseHeader(raw)
+	if err != nil {
+		return err
+	}
+	r.Header = header
 
-	mapper_num := flag1 & 0xF0 >> 4
-	four_screen := flag1 & 0x08 >> 3
-	trainer := flag1 & 0x04 >> 2
-	battery := flag1 & 0x02 >> 1
-	mirroring := flag1 & 0x01
-	_ = four_screen
-	_ = battery
-	_ = mirroring
+	log.Printf("PRG: %d, CHR: %d\n", header.PRGROMSize, header.CHRROMSize)
+	log.Printf("MAPPER: %d\n", header.MapperNum)
 
-	mapper_num += flag2 & 0xF0
-	pc10 := flag2 & 0x02 >> 1
-	vs := flag2 & 0x01
-	_ = vs
+	if header.Trainer {
+		if err := readSection(buf, "trainer", r.Trainer[:]); err != nil {
+			return err
+		}
+	}
 
-	log.Printf("MAPPER: %d\n", mapper_num)
-	r.Header.MapperNum = int(mapper_num)
+	r.PRG = make([]byte, header.PRGROMSize)
+	if err := readSection(buf, "PRG-ROM", r.PRG); err != nil {
+		return err
+	}
 
-	if flag2&0x0C == 0x08 {
-		flag3, _ := buf.ReadByte()
-		flag4, _ := buf.ReadByte()
+	if header.CHRROMSize > 0 {
+		r.CHR = make([]byte, header.CHRROMSize)
+		if err := readSection(buf, "CHR-ROM", r.CHR); err != nil {
+			return err
+		}
+	}
 
-		pal := flag3 & 0x08 >> 3
-		bus_conflicts := flag4 & 0x80 >> 7
-		prg_ram := flag4 & 0x40 >> 6
-		tv_system := flag4 & 0x30 >> 4
-		_ = pal
-		_ = bus_conflicts
-		_ = prg_ram
-		_ = tv_system
+	r.allocateRAM()
+
+	if header.HasPC10InstROM() {
+		r.PC10InstROM = make([]byte, PC10InstROMSize)
+		if err := readSection(buf, "PlayChoice INST-ROM", r.PC10InstROM); err != nil {
+			return err
+		}
+		// many dumps lack the PROM, so only read it when it is complete
+		if buf.Len() >= PC10PROMSize {
+			r.PC10PROM = make([]byte, PC10PROMSize)
+			if err := readSection(buf, "PlayChoice PROM", r.PC10PROM); err != nil {
+				return err
+			}
+		} else {
+			log.Println("PlayChoice PROM is missing")
+		}
 	}
 
-	buf.Seek(16, io.SeekStart)
+	if header.MiscROMs > 0 {
+		r.MiscROM = make([]byte, buf.Len())
+		if err := readSection(buf, "misc ROM", r.MiscROM); err != nil {
+			return err
+		}
+	}
 
-	if trainer == 1 {
-		io.ReadFull(buf, r.Trainer[:])
+	if buf.Len() > 0 {
+		expected := len(data) - buf.Len()
+		if header.NES20 {
+			return &SizeMismatchError{expected, len(data)}
+		}
+		log.Printf("ignoring %d trailing bytes\n", buf.Len())
 	}
 
-	r.PRG = make([]byte, int64(prg_size)*16*1024)
-	r.CHR = make([]byte, int64(chr_size)*8*1024)
+	return nil
+}
 
-	io.ReadFull(buf, r.PRG)
-	io.ReadFull(buf, r.CHR)
+// allocateRAM sizes PRG-RAM, and CHR-RAM for boards without CHR-ROM,
+// from the header.
+func (r *rom) allocateRAM() {
+	if r.Header.CHRROMSize == 0 {
+		r.CHR = make([]byte, r.Header.CHRRAMSize+r.Header.CHRNVRAMSize)
+	}
+	r.PRGRAM = make([]byte, r.Header.PRGRAMSize+r.Header.PRGNVRAMSize)
+}
 
-	if pc10 == 1 {
-		io.ReadFull(buf, r.PC10InstROM)
+// CRC32 returns the checksum of PRG-ROM and CHR-ROM combined, which is
+// what the game database is keyed by.
+func (r *rom) CRC32() uint32 {
+	crc := crc32.ChecksumIEEE(r.PRG)
+	if r.Header.CHRROMSize > 0 {
+		crc = crc32.Update(crc, crc32.IEEETable, r.CHR)
 	}
+	return crc
+}
 
-	if buf.Len() >= 16 {
-		io.ReadFull(buf, r.PC10PROM)
+// StateID identifies the game in save states. It extends CRC32 with the
+// disk sides, as PRG-ROM only holds the BIOS for disk images.
+func (r *rom) StateID() uint32 {
+	crc := r.CRC32()
+	for _, side := range r.Disk {
+		crc = crc32.Update(crc, crc32.IEEETable, side)
 	}
+	return crc
+}
 
-	return nil
+// readSection fills target from buf, reporting a TruncatedError when buf
+// runs out first.
+func readSection(buf io.Reader, section string, target []byte) error {
+	n, err := io.ReadFull(buf, target)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &TruncatedError{section, len(target), n}
+	}
+	return err
 }
 
 func (r *rom) GetCHR(addr uint16) byte {
@@ -136,3 +230,17 @@ func (r *rom) SetPRG(addr uint16, value byte) {
 	}
 	r.PRG[addr] = value
 }
+
+func (r *rom) GetPRGRAM(addr uint16) byte {
+	if len(r.PRGRAM) == 0 {
+		return 0
+	}
+	return r.PRGRAM[int(addr)%len(r.PRGRAM)]
+}
+
+func (r *rom) SetPRGRAM(addr uint16, value byte) {
+	if len(r.PRGRAM) == 0 {
+		return
+	}
+	r.PRGRAM[int(addr)%len(r.PRGRAM)] = value
+}
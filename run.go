@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// runCommand plays a ROM in a window, or with -headless runs it for a
+// fixed number of frames without a display.
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configFlags := NewConfigFlags(fs)
+	rewindSeconds := fs.Float64("rewind", DefaultRewindSeconds, "rewind depth in seconds (0 disables rewind)")
+	rewindInterval := fs.Int("rewind-interval", DefaultRewindInterval, "frames between rewind snapshots")
+	fastForward := fs.Float64("ff", 4, "fast-forward speed multiplier")
+	slowMotion := fs.Float64("slow", 0.5, "slow motion speed multiplier")
+	headless := fs.Bool("headless", false, "run without a display")
+	frames := fs.Int("frames", 60, "number of frames to run with -headless")
+	screenshot := fs.String("screenshot", "", "write the last frame of a -headless run to this PNG file")
+	inputFile := fs.String("input", "", "input script for -headless runs")
+	cdlFile := fs.String("cdl", "", "log ROM usage to this FCEUX .cdl file, merging with its contents")
+	watchList := fs.String("watch", "", "comma-separated values to log when they change, as [SPACE:]ADDR[:FMT[:NAME]]")
+	freezeList := fs.String("freeze", "", "comma-separated values to hold every frame, as [SPACE:]ADDR[:FMT[:NAME]]=VALUE")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: nes run [flags] rom.nes")
+	}
+	if *fastForward <= 0 || *slowMotion <= 0 {
+		return fmt.Errorf("-ff and -slow must be greater than 0")
+	}
+
+	config, err := configFlags.Config()
+	if err != nil {
+		return err
+	}
+
+	var watches *WatchList
+	if *watchList != "" || *freezeList != "" {
+		watches = NewWatchList()
+		for _, spec := range splitList(*watchList) {
+			if _, err := watches.ParseWatch(spec); err != nil {
+				return err
+			}
+		}
+		for _, spec := range splitList(*freezeList) {
+			if _, err := watches.ParseFreeze(spec); err != nil {
+				return err
+			}
+		}
+		watches.OnChange = func(w *Watch) {
+			log.Printf("frame %d: %v\n", w.ChangedFrame, w)
+		}
+	}
+
+	if !*headless {
+		return play(fs.Arg(0), config, RunnerConfig{
+			RewindSeconds:  *rewindSeconds,
+			RewindInterval: *rewindInterval,
+			FastForward:    *fastForward,
+			SlowMotion:     *slowMotion,
+			CDLFile:        *cdlFile,
+			Watches:        watches,
+		})
+	}
+
+	var script InputScript
+	if *inputFile != "" {
+		script, err = LoadInputScript(*inputFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	fb := NewFrameBuffer()
+	nes, err := NewNES(fs.Arg(0), fb, config)
+	if err != nil {
+		return err
+	}
+
+	if *cdlFile != "" {
+		if err := nes.StartCDL(*cdlFile); err != nil {
+			return err
+		}
+	}
+
+	nes.Watches = watches
+	nes.PowerOn()
+	RunHeadless(nes, *frames, script)
+	if err := nes.FlushSave(); err != nil {
+		return err
+	}
+	if watches != nil {
+		watches.Write(os.Stdout)
+	}
+
+	if nes.CDL != nil {
+		if err := nes.CDL.Save(*cdlFile); err != nil {
+			return err
+		}
+	}
+
+	if *screenshot != "" {
+		return writePNG(*screenshot, fb.Image())
+	}
+	return nil
+}
+
+// RunHeadless runs frames video frames as fast as possible, feeding the
+// controllers from script.
+func RunHeadless(nes *NES, frames int, script InputScript) {
+	next := 0
+	for frame := 0; frame < frames; frame++ {
+		for next < len(script) && script[next].Frame <= frame {
+			nes.Controllers[0].Buttons = script[next].Buttons[0]
+			nes.Controllers[1].Buttons = script[next].Buttons[1]
+			next++
+		}
+		nes.RunFrame()
+	}
+	log.Printf("ran %d frames\n", frames)
+}
+
+// InputEvent sets the controller buttons from Frame on, until the next
+// event.
+type InputEvent struct {
+	Frame   int
+	Buttons [2]byte
+}
+
+// InputScript is a list of input events ordered by frame.
+type InputScript []InputEvent
+
+var buttonNames = map[string]byte{
+	"a":      ButtonA,
+	"b":      ButtonB,
+	"select": ButtonSelect,
+	"start":  ButtonStart,
+	"up":     ButtonUp,
+	"down":   ButtonDown,
+	"left":   ButtonLeft,
+	"right":  ButtonRight,
+}
+
+func LoadInputScript(file string) (InputScript, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseInputScript(f)
+}
+
+// ParseInputScript reads an input script. Each line holds a frame number
+// followed by the buttons held on controller 1 and, optionally,
+// controller 2, as comma-separated names or "-" for none:
+//
+//	# press start, then hold right while jumping
+//	60  start
+//	64  -
+//	120 right,a
+//	180 - start
+//
+// Blank lines and lines starting with # are ignored.
+func ParseInputScript(r io.Reader) (InputScript, error) {
+	var script InputScript
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("input script line %d: too many fields", line)
+		}
+		frame, err := strconv.Atoi(fields[0])
+		if err != nil || frame < 0 {
+			return nil, fmt.Errorf("input script line %d: bad frame %q", line, fields[0])
+		}
+		event := InputEvent{Frame: frame}
+		for i, field := range fields[1:] {
+			buttons, err := parseButtons(field)
+			if err != nil {
+				return nil, fmt.Errorf("input script line %d: %v", line, err)
+			}
+			event.Buttons[i] = buttons
+		}
+		script = append(script, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(script, func(i, j int) bool {
+		return script[i].Frame < script[j].Frame
+	})
+	return script, nil
+}
+
+func parseButtons(s string) (byte, error) {
+	if s == "-" {
+		return 0, nil
+	}
+	var buttons byte
+	for _, name := range strings.Split(s, ",") {
+		b, ok := buttonNames[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown button %q", name)
+		}
+		buttons |= b
+	}
+	return buttons, nil
+}
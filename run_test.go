@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestRunHeadlessFlushesSave(t *testing.T) {
+	// battery-backed PRG-RAM
+	data := testLoopINES()
+	data[6] |= 0x02
+	prg := data[HeaderSize:]
+	copy(prg, []byte{
+		0xA9, 0x42, // LDA #$42
+		0x8D, 0x00, 0x60, // STA $6000
+		0x4C, 0x05, 0x80, // JMP $8005
+	})
+	rom := testROMFile(t, data)
+	dir := t.TempDir()
+
+	if err := runCommand([]string{"-headless", "-frames", "2", "-savedir", dir, rom}); err != nil {
+		t.Fatal(err)
+	}
+	save, err := ioutil.ReadFile(SavePath(rom, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(save) == 0 || save[0] != 0x42 {
+		t.Errorf("save file does not hold the PRG-RAM write")
+	}
+}
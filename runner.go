@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Input is a snapshot of the player's input, sent from the display to the
+// emulation goroutine.
+type Input struct {
+	Buttons     [2]byte
+	FastForward bool
+	Rewind      bool
+}
+
+type RunnerConfig struct {
+	RewindSeconds  float64
+	RewindInterval int
+	FastForward    float64
+	SlowMotion     float64
+	// CDLFile logs ROM usage to this file, if set.
+	CDLFile string
+	// Watches is updated every frame, if set.
+	Watches *WatchList
+}
+
+// Runner runs the emulator on its own goroutine. Everything that touches
+// the NES goes through its channels.
+type Runner struct {
+	nes    *NES
+	config RunnerConfig
+
+	input    chan Input
+	commands chan func(r *Runner)
+
+	current Input
+	paused  bool
+	advance bool
+	slow    bool
+	slot    int
+	rewind  *Rewind
+	pacer   *Pacer
+}
+
+func NewRunner(nes *NES, config RunnerConfig) *Runner {
+	r := &Runner{
+		nes:      nes,
+		config:   config,
+		input:    make(chan Input, 1),
+		commands: make(chan func(r *Runner), 16),
+		pacer:    NewPacer(nes.Timing().FrameRate()),
+	}
+	if config.RewindSeconds > 0 {
+		r.rewind = NewRewind(config.RewindSeconds, config.RewindInterval, nes.Timing())
+	}
+	return r
+}
+
+// SetInput replaces the input seen by the emulator. Older snapshots that
+// were not picked up yet are dropped.
+func (r *Runner) SetInput(in Input) {
+	select {
+	case <-r.input:
+	default:
+	}
+	select {
+	case r.input <- in:
+	default:
+	}
+}
+
+// Do runs f on the emulation goroutine between frames.
+func (r *Runner) Do(f func(r *Runner)) {
+	r.commands <- f
+}
+
+func (r *Runner) TogglePause() {
+	r.Do(func(r *Runner) { r.paused = !r.paused })
+}
+
+// Advance runs a single frame while paused.
+func (r *Runner) Advance() {
+	r.Do(func(r *Runner) { r.advance = r.paused })
+}
+
+func (r *Runner) ToggleSlowMotion() {
+	r.Do(func(r *Runner) { r.slow = !r.slow })
+}
+
+func (r *Runner) SelectSlot(slot int) {
+	r.Do(func(r *Runner) {
+		r.slot = slot
+		log.Printf("state slot %d\n", slot)
+	})
+}
+
+func (r *Runner) SaveState() {
+	r.Do(func(r *Runner) {
+		if err := r.nes.SaveStateSlot(r.slot); err != nil {
+			log.Println(err)
+			return
+		}
+		log.Printf("saved state to slot %d\n", r.slot)
+	})
+}
+
+func (r *Runner) LoadState() {
+	r.Do(func(r *Runner) {
+		if err := r.nes.LoadStateSlot(r.slot); err != nil {
+			log.Println(err)
+			return
+		}
+		log.Printf("loaded state from slot %d\n", r.slot)
+	})
+}
+
+func (r *Runner) SwitchDiskSide() {
+	r.Do(func(r *Runner) { r.nes.SwitchDiskSide() })
+}
+
+// Run powers the NES on and runs it until ctx is cancelled, then writes
+// the save file and the code/data log.
+func (r *Runner) Run(ctx context.Context) error {
+	flush := time.NewTicker(SaveFlushInterval)
+	defer flush.Stop()
+
+	if r.config.CDLFile != "" {
+		if err := r.nes.StartCDL(r.config.CDLFile); err != nil {
+			return err
+		}
+	}
+
+	r.nes.Watches = r.config.Watches
+	r.nes.PowerOn()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return r.flush()
+		case <-flush.C:
+			if err := r.flush(); err != nil {
+				log.Println(err)
+			}
+		default:
+		}
+
+		r.poll()
+		r.frame()
+	}
+}
+
+// flush writes the save file and the code/data log.
+func (r *Runner) flush() error {
+	if err := r.nes.FlushSave(); err != nil {
+		return err
+	}
+	if r.nes.CDL != nil {
+		return r.nes.CDL.Save(r.config.CDLFile)
+	}
+	return nil
+}
+
+// poll picks up the latest input and runs pending commands.
+func (r *Runner) poll() {
+	select {
+	case in := <-r.input:
+		r.current = in
+	default:
+	}
+	for {
+		select {
+		case f := <-r.commands:
+			f(r)
+		default:
+			return
+		}
+	}
+}
+
+func (r *Runner) frame() {
+	switch {
+	case r.current.FastForward:
+		r.pacer.Speed = r.config.FastForward
+	case r.slow:
+		r.pacer.Speed = r.config.SlowMotion
+	default:
+		r.pacer.Speed = 1
+	}
+
+	if r.paused && !r.advance {
+		r.pacer.Wait()
+		return
+	}
+	r.advance = false
+
+	r.nes.Controllers[0].Buttons = r.current.Buttons[0]
+	r.nes.Controllers[1].Buttons = r.current.Buttons[1]
+
+	// there is no audio output yet, so nothing needs muting while
+	// rewinding
+	rewinding := r.rewind != nil && r.current.Rewind
+	if rewinding {
+		if err := r.rewind.Step(r.nes); err != nil && err != ErrRewindEmpty {
+			log.Println(err)
+		}
+	}
+
+	r.nes.RunFrame()
+
+	if r.rewind != nil && !rewinding {
+		if err := r.rewind.Push(r.nes); err != nil {
+			log.Println(err)
+		}
+	}
+
+	r.pacer.Wait()
+}
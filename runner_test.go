@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testLoopINES builds an NROM image whose reset, NMI and IRQ handlers all
+// jump to themselves.
+func testLoopINES() []byte {
+	data := testINES(1, 1, 0)
+	prg := data[HeaderSize : HeaderSize+16*1024]
+	copy(prg, []byte{0x4C, 0x00, 0x80}) // JMP $8000
+	for i := 0x3FFA; i < 0x4000; i += 2 {
+		prg[i], prg[i+1] = 0x00, 0x80
+	}
+	return data
+}
+
+// TestRunnerConcurrentAccess drives the runner the way the display does,
+// from another goroutine; run it with -race.
+func TestRunnerConcurrentAccess(t *testing.T) {
+	frames := NewTripleBuffer()
+	config := Config{SaveDir: t.TempDir()}
+	nes, err := NewNES(testROMFile(t, testLoopINES()), frames, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := NewRunner(nes, RunnerConfig{RewindSeconds: 1, RewindInterval: 1, FastForward: 8, SlowMotion: 0.5})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runner.Run(ctx) }()
+
+	timeout := time.After(10 * time.Second)
+	count := 0
+	for i := 0; count < 20; i++ {
+		select {
+		case <-frames.Ready():
+		case <-timeout:
+			t.Fatalf("only %d frames after 10s", count)
+		}
+		if img, fresh := frames.Frame(); fresh {
+			count++
+			_ = img.Pix[0]
+		}
+
+		runner.SetInput(Input{Buttons: [2]byte{byte(i)}, FastForward: i%2 == 0, Rewind: i%5 == 4})
+		switch i % 4 {
+		case 0:
+			runner.SaveState()
+		case 1:
+			runner.LoadState()
+		case 2:
+			runner.ToggleSlowMotion()
+		}
+		pc := make(chan uint16, 1)
+		runner.Do(func(r *Runner) { pc <- r.nes.CPU.PC })
+		if got := <-pc; got < 0x8000 || got > 0x8002 {
+			t.Fatalf("PC = %04X, want the loop at $8000", got)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const SaveFlushInterval = 5 * time.Second
+
+// SavePath returns the battery save file for a ROM: the ROM's base name
+// with a .sav extension, in dir or next to the ROM when dir is empty.
+func SavePath(romFile, dir string) string {
+	base := filepath.Base(romFile)
+	if strings.ToLower(filepath.Ext(base)) == ".gz" {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	base = strings.TrimSuffix(base, filepath.Ext(base)) + ".sav"
+	if dir == "" {
+		dir = filepath.Dir(romFile)
+	}
+	return filepath.Join(dir, base)
+}
+
+// readSave reads the save file at path. A missing file is not an error;
+// the game simply starts without a save.
+func readSave(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// writeSave writes ram to path through a temporary file in the same
+// directory, so a crash never leaves a half-written save behind.
+func writeSave(path string, ram []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(ram); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// saveData returns what goes into the save file: the mapper's own save
+// data if it has any, battery-backed PRG-RAM otherwise.
+func (n *NES) saveData() []byte {
+	if h, ok := n.MMC.(saveDataHolder); ok {
+		return h.SaveData()
+	}
+	return n.ROM.PRGRAM
+}
+
+func (n *NES) loadSave(path string) error {
+	n.savePath = path
+	data, err := readSave(path)
+	if err != nil {
+		return err
+	}
+	if h, ok := n.MMC.(saveDataHolder); ok {
+		if err := h.LoadSaveData(data); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	} else {
+		copy(n.ROM.PRGRAM, data)
+	}
+	n.saved = append([]byte(nil), n.saveData()...)
+	return nil
+}
+
+// FlushSave writes the save data to the save file if it changed since the
+// last flush.
+func (n *NES) FlushSave() error {
+	if n.savePath == "" {
+		return nil
+	}
+	data := n.saveData()
+	if bytes.Equal(n.saved, data) {
+		return nil
+	}
+	if err := writeSave(n.savePath, data); err != nil {
+		return err
+	}
+	n.saved = append(n.saved[:0], data...)
+	return nil
+}
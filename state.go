@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Save states are a magic, a version and a sequence of chunks, each a 4
+// byte tag, a 4 byte little-endian length and the chunk data. Loaders skip
+// chunks they do not know, and fields appended to a chunk by a later
+// version read as zero in an older state, so states stay loadable as the
+// format grows in either direction. A state also records the oldest
+// version that can read it; that is only raised when a change cannot be
+// handled by the rules above, and newer versions migrate older states.
+const (
+	StateMagic   = "NESS"
+	StateVersion = 2
+
+	// stateCompatVersion is the oldest version that can load the states
+	// written now.
+	stateCompatVersion = 1
+)
+
+var ErrStateMismatch = errors.New("save state belongs to another game")
+
+// stateWriter appends fields to a chunk.
+type stateWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *stateWriter) Byte(v byte) {
+	w.buf.WriteByte(v)
+}
+
+func (w *stateWriter) Bool(v bool) {
+	if v {
+		w.Byte(1)
+	} else {
+		w.Byte(0)
+	}
+}
+
+func (w *stateWriter) Uint16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *stateWriter) Uint32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *stateWriter) Int(v int) {
+	w.Uint32(uint32(int32(v)))
+}
+
+// Bytes writes a length-prefixed byte slice.
+func (w *stateWriter) Bytes(v []byte) {
+	w.Uint32(uint32(len(v)))
+	w.buf.Write(v)
+}
+
+// stateReader reads fields back from a chunk. Reading past the end of the
+// chunk yields zero values.
+type stateReader struct {
+	data []byte
+}
+
+func (r *stateReader) Byte() byte {
+	if len(r.data) < 1 {
+		return 0
+	}
+	v := r.data[0]
+	r.data = r.data[1:]
+	return v
+}
+
+func (r *stateReader) Bool() bool {
+	return r.Byte() != 0
+}
+
+func (r *stateReader) Uint16() uint16 {
+	if len(r.data) < 2 {
+		r.data = nil
+		return 0
+	}
+	v := binary.LittleEndian.Uint16(r.data)
+	r.data = r.data[2:]
+	return v
+}
+
+func (r *stateReader) Uint32() uint32 {
+	if len(r.data) < 4 {
+		r.data = nil
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *stateReader) Int() int {
+	return int(int32(r.Uint32()))
+}
+
+// Slice reads a length-prefixed byte slice.
+func (r *stateReader) Slice() []byte {
+	n := int(r.Uint32())
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v
+}
+
+// Bytes reads a length-prefixed byte slice into target. Data that does
+// not fit is dropped, and a short slice leaves the rest of target alone.
+func (r *stateReader) Bytes(target []byte) {
+	copy(target, r.Slice())
+}
+
+// stateful is implemented by components that take part in save states.
+type stateful interface {
+	SaveState(w *stateWriter)
+	LoadState(r *stateReader) error
+}
+
+type stateChunk struct {
+	tag string
+	s   stateful
+}
+
+// stateChunks lists the chunks of a save state in order.
+func (n *NES) stateChunks() []stateChunk {
+	chunks := []stateChunk{
+		{"CPU ", n.CPU},
+		{"PPU ", n.PPU},
+		{"APU ", n.APU},
+		{"RAM ", (*nesRAMState)(n)},
+		{"NES ", (*nesState)(n)},
+		{"CART", (*romState)(n.ROM)},
+	}
+	if s, ok := n.MMC.(stateful); ok {
+		chunks = append(chunks, stateChunk{"MMC ", s})
+	}
+	return chunks
+}
+
+// SaveState writes a snapshot of the whole machine to w.
+func (n *NES) SaveState(w io.Writer) error {
+	var out bytes.Buffer
+	out.WriteString(StateMagic)
+	binary.Write(&out, binary.LittleEndian, uint32(StateVersion))
+
+	id := &stateWriter{}
+	id.Uint32(n.ROM.StateID())
+	id.Uint32(stateCompatVersion)
+	writeChunk(&out, "ID  ", id.buf.Bytes())
+
+	for _, c := range n.stateChunks() {
+		sw := &stateWriter{}
+		c.s.SaveState(sw)
+		writeChunk(&out, c.tag, sw.buf.Bytes())
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func writeChunk(w *bytes.Buffer, tag string, data []byte) {
+	w.WriteString(tag)
+	binary.Write(w, binary.LittleEndian, uint32(len(data)))
+	w.Write(data)
+}
+
+// LoadState restores a snapshot written by SaveState. The machine is
+// left as it was when the state cannot be loaded.
+func (n *NES) LoadState(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(StateMagic)) || len(data) < 8 {
+		return ErrUnknownFormat
+	}
+	version := binary.LittleEndian.Uint32(data[4:])
+	if version == 0 {
+		return &StateVersionError{Version: version}
+	}
+	chunks := map[string][]byte{}
+	p := data[8:]
+	for len(p) > 0 {
+		if len(p) < 8 {
+			return &TruncatedError{"save state chunk header", 8, len(p)}
+		}
+		tag := string(p[:4])
+		size := int(binary.LittleEndian.Uint32(p[4:]))
+		p = p[8:]
+		if size > len(p) {
+			return &TruncatedError{"save state chunk " + strings.TrimSpace(tag), size, len(p)}
+		}
+		chunks[tag] = p[:size]
+		p = p[size:]
+	}
+
+	// the game ID is the one chunk that cannot fall back to zero values
+	if len(chunks["ID  "]) < 4 {
+		return &TruncatedError{"save state chunk ID", 4, len(chunks["ID  "])}
+	}
+	id := &stateReader{chunks["ID  "]}
+	if id.Uint32() != n.ROM.StateID() {
+		return ErrStateMismatch
+	}
+	// version 1 states do not record it, and are readable by version 1
+	if compat := id.Uint32(); compat > StateVersion {
+		return &StateVersionError{Version: version, Compat: compat}
+	}
+	migrateState(version, chunks)
+
+	var backup bytes.Buffer
+	if err := n.SaveState(&backup); err != nil {
+		return err
+	}
+	if err := n.loadChunks(chunks); err != nil {
+		// restoring what was just saved cannot fail
+		n.LoadState(&backup)
+		return err
+	}
+	return nil
+}
+
+// migrateState brings the chunks of an older state up to the current
+// version.
+func migrateState(version uint32, chunks map[string][]byte) {
+	if version < 2 {
+		// no NES chunk yet: controllers, the PPU dot remainder and DMA
+		// start from zero rather than keeping their current values
+		chunks["NES "] = nil
+	}
+}
+
+func (n *NES) loadChunks(chunks map[string][]byte) error {
+	for _, c := range n.stateChunks() {
+		if d, ok := chunks[c.tag]; ok {
+			if err := c.s.LoadState(&stateReader{d}); err != nil {
+				return fmt.Errorf("save state chunk %s: %v", strings.TrimSpace(c.tag), err)
+			}
+		}
+	}
+	return nil
+}
+
+// StatePath returns the file for a numbered save state slot, kept with
+// the battery save.
+func (n *NES) StatePath(slot int) string {
+	archive, _ := splitArchivePath(n.romFile)
+	base := strings.TrimSuffix(SavePath(archive, n.config.SaveDir), ".sav")
+	return fmt.Sprintf("%s.ss%d", base, slot)
+}
+
+// SaveStateSlot writes a save state to a numbered slot.
+func (n *NES) SaveStateSlot(slot int) error {
+	var buf bytes.Buffer
+	if err := n.SaveState(&buf); err != nil {
+		return err
+	}
+	return writeSave(n.StatePath(slot), buf.Bytes())
+}
+
+// LoadStateSlot restores the save state in a numbered slot.
+func (n *NES) LoadStateSlot(slot int) error {
+	data, err := ioutil.ReadFile(n.StatePath(slot))
+	if err != nil {
+		return err
+	}
+	return n.LoadState(bytes.NewReader(data))
+}
+
+func (c *cpu) SaveState(w *stateWriter) {
+	w.Byte(c.A)
+	w.Byte(c.X)
+	w.Byte(c.Y)
+	w.Byte(c.S)
+	w.Byte(c.P)
+	w.Uint16(c.PC)
+	w.Int(c.interrupt)
+	w.Int(c.Cycle)
+}
+
+func (c *cpu) LoadState(r *stateReader) error {
+	c.A = r.Byte()
+	c.X = r.Byte()
+	c.Y = r.Byte()
+	c.S = r.Byte()
+	c.P = r.Byte()
+	c.PC = r.Uint16()
+	c.interrupt = r.Int()
+	c.Cycle = r.Int()
+	return nil
+}
+
+func (p *ppu) SaveState(w *stateWriter) {
+	w.Byte(p.Ctrl)
+	w.Byte(p.Mask)
+	w.Bytes(p.buffer)
+	w.Bool(p.vblank)
+	w.Bool(p.spriteZeroHit)
+	w.Int(p.Cycle)
+	w.Int(p.Line)
+	w.Bytes(p.oam[:])
+	w.Int(p.Frame)
+	w.Byte(p.scrollX)
+	w.Byte(p.scrollY)
+}
+
+func (p *ppu) LoadState(r *stateReader) error {
+	p.Ctrl = r.Byte()
+	p.Mask = r.Byte()
+	buffer := r.Slice()
+	if len(buffer) > cap(p.buffer) {
+		buffer = buffer[:cap(p.buffer)]
+	}
+	p.buffer = append(p.buffer[:0], buffer...)
+	p.vblank = r.Bool()
+	p.spriteZeroHit = r.Bool()
+	p.Cycle = r.Int()
+	p.Line = r.Int()
+	r.Bytes(p.oam[:])
+	p.Frame = r.Int()
+	p.scrollX = r.Byte()
+	p.scrollY = r.Byte()
+	return nil
+}
+
+func (a *apu) SaveState(w *stateWriter) {
+	w.Bytes(a.Pulse[:])
+	w.Bytes(a.Triangle[:])
+	w.Bytes(a.Noise[:])
+	w.Bytes(a.DMC[:])
+	w.Byte(a.Status)
+	w.Byte(a.FrameCounter)
+}
+
+func (a *apu) LoadState(r *stateReader) error {
+	r.Bytes(a.Pulse[:])
+	r.Bytes(a.Triangle[:])
+	r.Bytes(a.Noise[:])
+	r.Bytes(a.DMC[:])
+	a.Status = r.Byte()
+	a.FrameCounter = r.Byte()
+	return nil
+}
+
+// nesRAMState saves the console's own memory: VRAM (with palette RAM)
+// and WRAM.
+type nesRAMState NES
+
+func (s *nesRAMState) SaveState(w *stateWriter) {
+	w.Bytes(s.vram[:])
+	w.Bytes(s.wram[:])
+}
+
+func (s *nesRAMState) LoadState(r *stateReader) error {
+	r.Bytes(s.vram[:])
+	r.Bytes(s.wram[:])
+	return nil
+}
+
+// nesState saves the console state outside the chips: the controller
+// shift registers, the PPU dots owed to the CPU and a pending DMA stall.
+type nesState NES
+
+func (s *nesState) SaveState(w *stateWriter) {
+	for i := range s.Controllers {
+		w.Byte(s.Controllers[i].index)
+		w.Bool(s.Controllers[i].strobe)
+	}
+	w.Int(s.dots)
+	w.Int(s.dma.stall)
+}
+
+func (s *nesState) LoadState(r *stateReader) error {
+	for i := range s.Controllers {
+		s.Controllers[i].index = r.Byte()
+		s.Controllers[i].strobe = r.Bool()
+	}
+	s.dots = r.Int()
+	s.dma.stall = r.Int()
+	if s.dots < 0 || s.dma.stall < 0 {
+		return errors.New("negative cycle count")
+	}
+	return nil
+}
+
+// romState saves the writable memory on the cartridge: PRG-RAM and
+// CHR-RAM.
+type romState rom
+
+func (s *romState) SaveState(w *stateWriter) {
+	w.Bytes(s.PRGRAM)
+	if s.Header.CHRROMSize == 0 {
+		w.Bytes(s.CHR)
+	} else {
+		w.Bytes(nil)
+	}
+}
+
+func (s *romState) LoadState(r *stateReader) error {
+	r.Bytes(s.PRGRAM)
+	if s.Header.CHRROMSize == 0 {
+		r.Bytes(s.CHR)
+	} else {
+		r.Bytes(nil)
+	}
+	return nil
+}
+
+func (m *mmc0) SaveState(w *stateWriter) {
+	w.Uint16(m.bankAddr1)
+	w.Uint16(m.bankAddr2)
+}
+
+func (m *mmc0) LoadState(r *stateReader) error {
+	m.bankAddr1 = r.Uint16()
+	m.bankAddr2 = r.Uint16()
+	return nil
+}
+
+func (f *fds) SaveState(w *stateWriter) {
+	w.Int(f.side)
+	w.Bool(f.inserted)
+	w.Int(f.swapSide)
+	w.Int(f.swapDelay)
+	w.Bool(f.diskIOEnabled)
+	w.Bool(f.soundIOEnabled)
+	w.Uint16(f.timerReload)
+	w.Uint16(f.timerCounter)
+	w.Bool(f.timerRepeat)
+	w.Bool(f.timerEnabled)
+	w.Bool(f.timerIRQ)
+	w.Bool(f.motorOn)
+	w.Bool(f.resetTransfer)
+	w.Bool(f.readMode)
+	w.Int(int(f.mirroring))
+	w.Bool(f.crcControl)
+	w.Bool(f.diskReady)
+	w.Bool(f.diskIRQEnable)
+	w.Bool(f.diskIRQ)
+	w.Int(f.position)
+	w.Int(f.delay)
+	w.Bool(f.endOfHead)
+	w.Bool(f.scanning)
+	w.Bool(f.gapEnded)
+	w.Bool(f.transferComplete)
+	w.Bool(f.previousCRC)
+	w.Uint16(f.crc)
+	w.Byte(f.readData)
+	w.Byte(f.writeData)
+	w.Byte(f.extData)
+	w.Bytes(f.SaveData())
+}
+
+func (f *fds) LoadState(r *stateReader) error {
+	f.side = r.Int()
+	f.inserted = r.Bool()
+	f.swapSide = r.Int()
+	f.swapDelay = r.Int()
+	f.diskIOEnabled = r.Bool()
+	f.soundIOEnabled = r.Bool()
+	f.timerReload = r.Uint16()
+	f.timerCounter = r.Uint16()
+	f.timerRepeat = r.Bool()
+	f.timerEnabled = r.Bool()
+	f.timerIRQ = r.Bool()
+	f.motorOn = r.Bool()
+	f.resetTransfer = r.Bool()
+	f.readMode = r.Bool()
+	f.mirroring = Mirroring(r.Int())
+	f.crcControl = r.Bool()
+	f.diskReady = r.Bool()
+	f.diskIRQEnable = r.Bool()
+	f.diskIRQ = r.Bool()
+	f.position = r.Int()
+	f.delay = r.Int()
+	f.endOfHead = r.Bool()
+	f.scanning = r.Bool()
+	f.gapEnded = r.Bool()
+	f.transferComplete = r.Bool()
+	f.previousCRC = r.Bool()
+	f.crc = r.Uint16()
+	f.readData = r.Byte()
+	f.writeData = r.Byte()
+	f.extData = r.Byte()
+
+	f.layoutTracks()
+	if err := f.LoadSaveData(r.Slice()); err != nil {
+		return err
+	}
+	if f.side < 0 || f.side >= len(f.tracks) {
+		return fmt.Errorf("disk side %d out of range", f.side)
+	}
+	if f.position < 0 || f.position >= len(f.tracks[f.side]) {
+		return fmt.Errorf("disk position %d out of range", f.position)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testROMFile writes data to a temporary ROM file.
+func testROMFile(t *testing.T, data []byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "test.nes")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func testNES(t *testing.T, data []byte) *NES {
+	t.Helper()
+	n, err := NewNES(testROMFile(t, data), NewFrameBuffer(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStateNewerVersion(t *testing.T) {
+	n := testNES(t, testINES(1, 1, 0))
+	n.wram[0x10] = 0x42
+	var buf bytes.Buffer
+	if err := n.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	state := buf.Bytes()
+	binary.LittleEndian.PutUint32(state[4:], StateVersion+1)
+	writeChunk(&buf, "NEW ", []byte{1, 2, 3})
+
+	n.wram[0x10] = 0
+	if err := n.LoadState(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if n.wram[0x10] != 0x42 {
+		t.Errorf("RAM not restored: got %02X", n.wram[0x10])
+	}
+}
+
+func TestStateID(t *testing.T) {
+	n := testNES(t, testINES(1, 1, 0))
+
+	var state bytes.Buffer
+	state.WriteString(StateMagic)
+	binary.Write(&state, binary.LittleEndian, uint32(StateVersion))
+	if err := n.LoadState(bytes.NewReader(state.Bytes())); err == nil {
+		t.Error("state without an ID chunk loaded")
+	}
+
+	other := testNES(t, testINES(2, 1, 0))
+	state.Reset()
+	if err := other.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.LoadState(&state); err != ErrStateMismatch {
+		t.Errorf("got %v, want ErrStateMismatch", err)
+	}
+}
+
+func TestStateIDCoversDisk(t *testing.T) {
+	bios := make([]byte, FDSBIOSSize)
+	a := &rom{PRG: bios, Disk: [][]byte{make([]byte, FDSSideSize)}}
+	b := &rom{PRG: bios, Disk: [][]byte{make([]byte, FDSSideSize)}}
+	b.Disk[0][100] = 1
+	if a.StateID() == b.StateID() {
+		t.Error("disks with the same BIOS share a state ID")
+	}
+}
+
+// findStateChunk returns the data of a chunk in a save state.
+func findStateChunk(t *testing.T, state []byte, tag string) []byte {
+	t.Helper()
+	for p := state[8:]; len(p) >= 8; {
+		size := int(binary.LittleEndian.Uint32(p[4:]))
+		if string(p[:4]) == tag {
+			return p[8 : 8+size]
+		}
+		p = p[8+size:]
+	}
+	t.Fatalf("no %q chunk", tag)
+	return nil
+}
+
+func TestStateVersions(t *testing.T) {
+	n := testNES(t, testINES(1, 1, 0))
+	var buf bytes.Buffer
+	if err := n.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	state := append([]byte{}, buf.Bytes()...)
+	binary.LittleEndian.PutUint32(state[4:], 0)
+	if _, ok := n.LoadState(bytes.NewReader(state)).(*StateVersionError); !ok {
+		t.Error("version 0 loaded")
+	}
+
+	state = append([]byte{}, buf.Bytes()...)
+	binary.LittleEndian.PutUint32(findStateChunk(t, state, "ID  ")[4:], StateVersion+1)
+	if _, ok := n.LoadState(bytes.NewReader(state)).(*StateVersionError); !ok {
+		t.Error("state needing a newer version loaded")
+	}
+}
+
+func TestStateControllers(t *testing.T) {
+	n := testNES(t, testINES(1, 1, 0))
+	n.Controllers[0].Buttons = ButtonA | ButtonStart
+	n.Controllers[0].Write(1)
+	n.Controllers[0].Write(0)
+	n.Controllers[0].Read()
+	n.dots = 3
+
+	var buf bytes.Buffer
+	if err := n.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	n.Controllers[0].Read()
+	n.Controllers[0].Read()
+	n.dots = 0
+	if err := n.LoadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n.Controllers[0].index != 1 || n.dots != 3 {
+		t.Errorf("controller index %d, dots %d; want 1 and 3", n.Controllers[0].index, n.dots)
+	}
+}
+
+func TestStateCorruptFDS(t *testing.T) {
+	dir := t.TempDir()
+	disk := make([]byte, FDSSideSize)
+	copy(disk, fdsDiskMagic)
+	bios := filepath.Join(dir, FDSBIOSName)
+	if err := ioutil.WriteFile(bios, make([]byte, FDSBIOSSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "test.fds")
+	if err := ioutil.WriteFile(file, disk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewNES(file, NewFrameBuffer(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := n.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	state := buf.Bytes()
+	// the disk side comes first
+	binary.LittleEndian.PutUint32(findStateChunk(t, state, "MMC "), 0xFFFFFFFF)
+
+	n.wram[0] = 0x55
+	if err := n.LoadState(bytes.NewReader(state)); err == nil {
+		t.Fatal("state with side -1 loaded")
+	}
+	if n.wram[0] != 0x55 {
+		t.Error("a failed load changed the machine")
+	}
+}
+
+func TestStatePPUScroll(t *testing.T) {
+	n := testNES(t, testINES(1, 1, 0))
+	n.PPU.SetScroll(12)
+	n.PPU.SetScroll(34)
+	var buf bytes.Buffer
+	if err := n.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	n.PPU.SetScroll(0)
+	n.PPU.SetScroll(0)
+	if err := n.LoadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n.PPU.scrollX != 12 || n.PPU.scrollY != 34 {
+		t.Errorf("scroll = %d,%d, want 12,34", n.PPU.scrollX, n.PPU.scrollY)
+	}
+}
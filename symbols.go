@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Symbol names an address. ROM symbols are tied to a PRG-ROM offset, so
+// they only apply while their bank is mapped; others to a CPU address.
+type Symbol struct {
+	Name string
+	Addr uint16
+	// Offset is the PRG-ROM offset, or -1.
+	Offset int
+	// Size is the number of bytes named, or 0 when unknown.
+	Size int
+}
+
+// SourceLine is a line of assembly source.
+type SourceLine struct {
+	File string
+	Line int
+}
+
+func (l SourceLine) String() string {
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// Symbols holds labels and source lines loaded from debug files.
+type Symbols struct {
+	rom    []*Symbol // sorted by Offset
+	ram    []*Symbol // sorted by Addr
+	byName map[string]*Symbol
+	lines  []sourceSpan // sorted by start
+}
+
+type sourceSpan struct {
+	start, end int // PRG-ROM offsets, end exclusive
+	line       SourceLine
+}
+
+func NewSymbols() *Symbols {
+	return &Symbols{byName: map[string]*Symbol{}}
+}
+
+// symbolContext is how far past a ROM label without a size addresses
+// are still shown relative to it.
+const symbolContext = 0x100
+
+// Add adds a symbol, replacing any other at the same place.
+func (s *Symbols) Add(sym *Symbol) {
+	var old *Symbol
+	if sym.Offset >= 0 {
+		s.rom, old = insertSymbol(s.rom, sym, func(a *Symbol) int { return a.Offset })
+	} else {
+		s.ram, old = insertSymbol(s.ram, sym, func(a *Symbol) int { return int(a.Addr) })
+	}
+	if old != nil && s.byName[old.Name] == old {
+		delete(s.byName, old.Name)
+	}
+	s.byName[sym.Name] = sym
+}
+
+// insertSymbol adds sym to list in order, returning the symbol it
+// replaced, if any.
+func insertSymbol(list []*Symbol, sym *Symbol, key func(*Symbol) int) ([]*Symbol, *Symbol) {
+	i := sort.Search(len(list), func(i int) bool { return key(list[i]) >= key(sym) })
+	if i < len(list) && key(list[i]) == key(sym) {
+		old := list[i]
+		list[i] = sym
+		return list, old
+	}
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = sym
+	return list, nil
+}
+
+// Find returns the symbol called name.
+func (s *Symbols) Find(name string) (*Symbol, bool) {
+	sym, ok := s.byName[name]
+	return sym, ok
+}
+
+// Lookup returns the symbol at addr exactly. offset is the PRG-ROM
+// offset mapped at addr, or -1.
+func (s *Symbols) Lookup(addr uint16, offset int) (*Symbol, bool) {
+	if offset >= 0 {
+		i := sort.Search(len(s.rom), func(i int) bool { return s.rom[i].Offset >= offset })
+		if i < len(s.rom) && s.rom[i].Offset == offset {
+			return s.rom[i], true
+		}
+		return nil, false
+	}
+	i := sort.Search(len(s.ram), func(i int) bool { return s.ram[i].Addr >= addr })
+	if i < len(s.ram) && s.ram[i].Addr == addr {
+		return s.ram[i], true
+	}
+	return nil, false
+}
+
+// Name describes addr as "label" or "label+N", or returns "" when no
+// symbol covers it.
+func (s *Symbols) Name(addr uint16, offset int) string {
+	var sym *Symbol
+	var delta int
+	if offset >= 0 {
+		i := sort.Search(len(s.rom), func(i int) bool { return s.rom[i].Offset > offset })
+		if i == 0 {
+			return ""
+		}
+		sym = s.rom[i-1]
+		delta = offset - sym.Offset
+	} else {
+		i := sort.Search(len(s.ram), func(i int) bool { return s.ram[i].Addr > addr })
+		if i == 0 {
+			return ""
+		}
+		sym = s.ram[i-1]
+		delta = int(addr - sym.Addr)
+	}
+	switch {
+	case delta == 0:
+		return sym.Name
+	case sym.Size > 0 && delta < sym.Size,
+		sym.Size == 0 && offset >= 0 && delta < symbolContext:
+		return fmt.Sprintf("%s+%d", sym.Name, delta)
+	}
+	return ""
+}
+
+// Line returns the source line assembled at a PRG-ROM offset.
+func (s *Symbols) Line(offset int) (SourceLine, bool) {
+	i := sort.Search(len(s.lines), func(i int) bool { return s.lines[i].start > offset })
+	if i == 0 || offset >= s.lines[i-1].end {
+		return SourceLine{}, false
+	}
+	return s.lines[i-1].line, true
+}
+
+func (s *Symbols) addLine(start, end int, line SourceLine) {
+	s.lines = append(s.lines, sourceSpan{start, end, line})
+}
+
+func (s *Symbols) sortLines() {
+	sort.SliceStable(s.lines, func(i, j int) bool { return s.lines[i].start < s.lines[j].start })
+}
+
+// LoadFile loads symbols from a ld65 debug file (.dbg), a Mesen label
+// file (.mlb) or an FCEUX name list (.nl) into s.
+func (s *Symbols) LoadFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".dbg":
+		err = s.loadDbg(f)
+	case ".mlb":
+		err = s.loadMLB(f)
+	case ".nl":
+		bank := -1
+		// FCEUX names them rom.nes.ram.nl and rom.nes.<bank>.nl
+		part := filepath.Ext(strings.TrimSuffix(file, filepath.Ext(file)))
+		if part != ".ram" {
+			b, err := strconv.ParseInt(strings.TrimPrefix(part, "."), 16, 32)
+			if err != nil {
+				return fmt.Errorf("%s: cannot tell the bank from the file name", file)
+			}
+			bank = int(b)
+		}
+		err = s.loadNL(f, bank)
+	default:
+		return fmt.Errorf("%s: unknown symbol file type", file)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+// FindSymbolFiles returns the debug files next to a ROM: rom.dbg,
+// rom.mlb and FCEUX's rom.nes.*.nl.
+func FindSymbolFiles(romFile string) []string {
+	base := strings.TrimSuffix(romFile, filepath.Ext(romFile))
+	var files []string
+	for _, ext := range []string{".dbg", ".mlb"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			files = append(files, base+ext)
+		}
+	}
+	nl, _ := filepath.Glob(romFile + ".*.nl")
+	return append(files, nl...)
+}
+
+// LoadSymbolFiles loads files, or the ones found next to romFile when
+// files is empty.
+func LoadSymbolFiles(files []string, romFile string) (*Symbols, error) {
+	if len(files) == 0 {
+		files = FindSymbolFiles(romFile)
+	}
+	s := NewSymbols()
+	for _, file := range files {
+		if err := s.LoadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// FCEUX .nl banks are 16KB
+const nlBankSize = 0x4000
+
+// loadNL reads an FCEUX name list: lines of "$ADDR#name#comment", with
+// "$ADDR/SIZE" for arrays. bank is -1 for the RAM file.
+func (s *Symbols) loadNL(r io.Reader, bank int) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(text, "$") {
+			continue
+		}
+		fields := strings.SplitN(text[1:], "#", 3)
+		if len(fields) < 2 || fields[1] == "" {
+			continue
+		}
+		addrSize := strings.SplitN(fields[0], "/", 2)
+		addr, err := strconv.ParseUint(addrSize[0], 16, 16)
+		if err != nil {
+			return fmt.Errorf("line %d: bad address %q", line, addrSize[0])
+		}
+		sym := &Symbol{Name: fields[1], Addr: uint16(addr), Offset: -1}
+		if len(addrSize) == 2 {
+			size, err := strconv.ParseUint(addrSize[1], 16, 16)
+			if err != nil {
+				return fmt.Errorf("line %d: bad size %q", line, addrSize[1])
+			}
+			sym.Size = int(size)
+		}
+		if bank >= 0 && addr >= 0x8000 {
+			sym.Offset = bank*nlBankSize + int(addr)%nlBankSize
+		}
+		s.Add(sym)
+	}
+	return scanner.Err()
+}
+
+// loadMLB reads a Mesen label file: lines of "TYPE:ADDR[-END]:name[:comment]"
+// with the types of Mesen 1 (P, R, S, W, G) or Mesen 2 (NesPrgRom, ...).
+func (s *Symbols) loadMLB(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 4)
+		if len(fields) < 3 || fields[2] == "" {
+			continue
+		}
+		bounds := strings.SplitN(fields[1], "-", 2)
+		start, err := strconv.ParseUint(bounds[0], 16, 32)
+		if err != nil {
+			return fmt.Errorf("line %d: bad address %q", line, bounds[0])
+		}
+		size := 0
+		if len(bounds) == 2 {
+			end, err := strconv.ParseUint(bounds[1], 16, 32)
+			if err != nil || end < start {
+				return fmt.Errorf("line %d: bad range %q", line, fields[1])
+			}
+			size = int(end-start) + 1
+		}
+
+		sym := &Symbol{Name: fields[2], Offset: -1, Size: size}
+		switch fields[0] {
+		case "P", "NesPrgRom":
+			sym.Offset = int(start)
+			// the CPU address depends on the mapper; assume the usual
+			// 16KB banks at $8000 until it is known
+			sym.Addr = 0x8000 + uint16(start%nlBankSize)
+		case "R", "NesInternalRam":
+			sym.Addr = uint16(start % 0x800)
+		case "S", "W", "NesSaveRam", "NesWorkRam":
+			sym.Addr = 0x6000 + uint16(start%0x2000)
+		case "G", "NesMemory", "NesRegister":
+			sym.Addr = uint16(start)
+		default:
+			continue
+		}
+		s.Add(sym)
+	}
+	return scanner.Err()
+}
+
+// loadDbg reads the debug file written by ld65 --dbgfile. ROM offsets
+// are taken from the segments' output offsets, less the 16 byte iNES
+// header.
+func (s *Symbols) loadDbg(r io.Reader) error {
+	type segment struct {
+		start  int
+		output int // PRG-ROM offset, or -1 for segments not in ROM
+	}
+	type span struct {
+		seg, start, size int
+	}
+	files := map[int]string{}
+	segs := map[int]segment{}
+	spans := map[int]span{}
+	type lineRecord struct {
+		line  SourceLine
+		spans []int
+	}
+	var lines []lineRecord
+	type symRecord struct {
+		name     string
+		val, seg int
+		size     int
+	}
+	var syms []symRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		kind, attrs, err := parseDbgLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		switch kind {
+		case "file":
+			files[dbgInt(attrs, "id", -1)] = strings.Trim(attrs["name"], `"`)
+		case "seg":
+			output := -1
+			if _, ok := attrs["ooffs"]; ok {
+				output = dbgInt(attrs, "ooffs", 0) - HeaderSize
+			}
+			segs[dbgInt(attrs, "id", -1)] = segment{dbgInt(attrs, "start", 0), output}
+		case "span":
+			spans[dbgInt(attrs, "id", -1)] = span{dbgInt(attrs, "seg", -1), dbgInt(attrs, "start", 0), dbgInt(attrs, "size", 0)}
+		case "line":
+			rec := lineRecord{line: SourceLine{files[dbgInt(attrs, "file", -1)], dbgInt(attrs, "line", 0)}}
+			// only lines that produced code or data have spans
+			if v, ok := attrs["span"]; ok {
+				for _, id := range strings.Split(v, "+") {
+					i, err := strconv.Atoi(id)
+					if err == nil {
+						rec.spans = append(rec.spans, i)
+					}
+				}
+			}
+			if dbgInt(attrs, "type", 0) == 0 && len(rec.spans) > 0 {
+				lines = append(lines, rec)
+			}
+		case "sym":
+			if attrs["type"] != "lab" {
+				continue
+			}
+			syms = append(syms, symRecord{
+				name: strings.Trim(attrs["name"], `"`),
+				val:  dbgInt(attrs, "val", 0),
+				seg:  dbgInt(attrs, "seg", -1),
+				size: dbgInt(attrs, "size", 0),
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, rec := range syms {
+		sym := &Symbol{Name: rec.name, Addr: uint16(rec.val), Offset: -1, Size: rec.size}
+		if seg, ok := segs[rec.seg]; ok && seg.output >= 0 {
+			sym.Offset = seg.output + rec.val - seg.start
+		}
+		s.Add(sym)
+	}
+	for _, rec := range lines {
+		for _, id := range rec.spans {
+			sp, ok := spans[id]
+			if !ok {
+				continue
+			}
+			seg, ok := segs[sp.seg]
+			if !ok || seg.output < 0 {
+				continue
+			}
+			start := seg.output + sp.start
+			s.addLine(start, start+sp.size, rec.line)
+		}
+	}
+	s.sortLines()
+	return nil
+}
+
+// parseDbgLine splits a ld65 debug file line like
+// `sym	id=0,name="reset",val=0x8000` into its kind and attributes.
+func parseDbgLine(line string) (string, map[string]string, error) {
+	attrs := map[string]string{}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", attrs, nil
+	}
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return line, attrs, nil
+	}
+	kind, rest := line[:i], strings.TrimSpace(line[i:])
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return "", nil, fmt.Errorf("bad attribute %q", rest)
+		}
+		key := rest[:eq]
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated string in %q", key)
+			}
+			value, rest = rest[:end+2], rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		attrs[key] = value
+		rest = strings.TrimPrefix(rest, ",")
+	}
+	return kind, attrs, nil
+}
+
+func dbgInt(attrs map[string]string, key string, def int) int {
+	v, ok := attrs[key]
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 0, 64)
+	if err != nil {
+		return def
+	}
+	return int(n)
+}
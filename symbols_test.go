@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymbolsAddReplaces(t *testing.T) {
+	s := NewSymbols()
+	s.Add(&Symbol{Name: "old", Addr: 0x8000, Offset: 0})
+	s.Add(&Symbol{Name: "new", Addr: 0x8000, Offset: 0})
+	s.Add(&Symbol{Name: "counter", Addr: 0x0010, Offset: -1})
+	s.Add(&Symbol{Name: "timer", Addr: 0x0010, Offset: -1})
+
+	for _, name := range []string{"old", "counter"} {
+		if _, ok := s.Find(name); ok {
+			t.Errorf("replaced symbol %s is still found", name)
+		}
+	}
+	if sym, ok := s.Lookup(0x8000, 0); !ok || sym.Name != "new" {
+		t.Errorf("Lookup($8000) = %v, want new", sym)
+	}
+	if sym, ok := s.Find("timer"); !ok || sym.Addr != 0x0010 {
+		t.Errorf("Find(timer) = %v", sym)
+	}
+}
+
+// writeSymbolFiles writes files next to a ROM path in a temporary
+// directory and returns the ROM path.
+func writeSymbolFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "game.nes")
+}
+
+type symbolCheck struct {
+	addr   uint16
+	offset int
+	name   string
+}
+
+func checkSymbolNames(t *testing.T, s *Symbols, checks []symbolCheck) {
+	t.Helper()
+	for _, c := range checks {
+		if got := s.Name(c.addr, c.offset); got != c.name {
+			t.Errorf("Name($%04X, %d) = %q, want %q", c.addr, c.offset, got, c.name)
+		}
+	}
+}
+
+func TestLoadNL(t *testing.T) {
+	rom := writeSymbolFiles(t, map[string]string{
+		"game.nes.0.nl":   "$8000#reset#entry point\n$8010/4#table#\n",
+		"game.nes.1.nl":   "$C005#nmi#\n",
+		"game.nes.ram.nl": "$0010#counter#\n",
+	})
+	s, err := LoadSymbolFiles(nil, rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sym, ok := s.Lookup(0xC005, 0x4005); !ok || sym.Name != "nmi" {
+		t.Errorf("bank 1 label: got %v", sym)
+	}
+	checkSymbolNames(t, s, []symbolCheck{
+		{0x8000, 0, "reset"},
+		{0x8005, 5, "reset+5"},
+		{0x8012, 0x12, "table+2"},
+		{0x8014, 0x14, ""},
+		{0xC006, 0x4006, "nmi+1"},
+		{0x0010, -1, "counter"},
+		{0x0011, -1, ""},
+	})
+}
+
+func TestLoadMLB(t *testing.T) {
+	rom := writeSymbolFiles(t, map[string]string{
+		"game.mlb": `P:0000:reset
+P:0010-0013:table
+R:0010:counter
+S:0000:save
+NesPrgRom:4005:nmi:bank 1
+NesInternalRam:0020-0021:lives
+NesWorkRam:0100:slot
+`,
+	})
+	s, err := LoadSymbolFiles(nil, rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sym, ok := s.Find("nmi"); !ok || sym.Offset != 0x4005 || sym.Addr != 0x8005 {
+		t.Errorf("Mesen 2 PRG label: got %v", sym)
+	}
+	checkSymbolNames(t, s, []symbolCheck{
+		{0x8000, 0, "reset"},
+		{0x8013, 0x13, "table+3"},
+		{0x8006, 0x4006, "nmi+1"},
+		{0x0010, -1, "counter"},
+		{0x6000, -1, "save"},
+		{0x0021, -1, "lives+1"},
+		{0x6100, -1, "slot"},
+	})
+}
+
+func TestLoadDbg(t *testing.T) {
+	rom := writeSymbolFiles(t, map[string]string{
+		"game.dbg": `version	major=2,minor=0
+file	id=0,name="main.s",size=100,mtime=0x0,mod=0
+seg	id=0,name="CODE",start=0x008000,size=0x0010,addrsize=absolute,type=ro,oname="game.nes",ooffs=16
+seg	id=1,name="BANK1",start=0x008000,size=0x0010,addrsize=absolute,type=ro,oname="game.nes",ooffs=16400
+seg	id=2,name="ZEROPAGE",start=0x000000,size=0x0002,addrsize=zeropage,type=rw
+span	id=0,seg=0,start=0,size=3
+span	id=1,seg=1,start=5,size=2
+line	id=0,file=0,line=10,span=0
+line	id=1,file=0,line=42,span=1
+line	id=2,file=0,line=50
+sym	id=0,name="reset",addrsize=absolute,scope=0,def=0,val=0x8000,seg=0,type=lab
+sym	id=1,name="far",addrsize=absolute,scope=0,def=1,val=0x8005,seg=1,type=lab,size=2
+sym	id=2,name="ptr",addrsize=zeropage,scope=0,def=2,val=0x0,seg=2,type=lab
+sym	id=3,name="SIZE",addrsize=zeropage,scope=0,def=2,val=0x4,type=equ
+`,
+	})
+	s, err := LoadSymbolFiles(nil, rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSymbolNames(t, s, []symbolCheck{
+		{0x8000, 0, "reset"},
+		{0x8005, 0x4005, "far"},
+		{0x8006, 0x4006, "far+1"},
+		{0x0000, -1, "ptr"},
+	})
+	if _, ok := s.Find("SIZE"); ok {
+		t.Error("constant loaded as a label")
+	}
+	lines := []struct {
+		offset int
+		want   string
+	}{
+		{0, "main.s:10"},
+		{2, "main.s:10"},
+		{3, ""},
+		{0x4005, "main.s:42"},
+		{0x4006, "main.s:42"},
+		{0x4007, ""},
+	}
+	for _, l := range lines {
+		got := ""
+		if line, ok := s.Line(l.offset); ok {
+			got = line.String()
+		}
+		if got != l.want {
+			t.Errorf("Line(%#x) = %q, want %q", l.offset, got, l.want)
+		}
+	}
+}
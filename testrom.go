@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Test ROMs in the style of blargg's suites report through PRG-RAM: once
+// $6001-$6003 hold the signature, $6000 is the status and $6004 on is a
+// NUL-terminated message.
+const (
+	TestAddressStatus    = 0x6000
+	TestAddressSignature = 0x6001
+	TestAddressText      = 0x6004
+
+	// status values; anything below $80 is the final result code
+	TestStatusRunning = 0x80
+	TestStatusReset   = 0x81
+)
+
+var testSignature = [3]byte{0xDE, 0xB0, 0x61}
+
+// the ROM asks for reset to be pressed no sooner than 100ms after it
+// writes TestStatusReset
+const testResetDelay = 6
+
+// DefaultTestTimeout is how long a test ROM may run, in seconds of
+// emulated time.
+const DefaultTestTimeout = 120
+
+type TestResult struct {
+	ROM     string
+	Code    int
+	Message string
+	Frames  int
+}
+
+func (r TestResult) Passed() bool {
+	return r.Code == 0
+}
+
+// RunTestROM boots a test ROM headless and runs it until it reports a
+// result or timeout seconds of emulated time pass.
+func RunTestROM(file string, config Config, timeout float64) (TestResult, error) {
+	result := TestResult{ROM: file, Code: -1}
+
+	nes, err := NewNES(file, NewFrameBuffer(), config)
+	if err != nil {
+		return result, err
+	}
+	// a battery save left over from an earlier run would hold a stale
+	// result
+	for i := range nes.ROM.PRGRAM {
+		nes.ROM.PRGRAM[i] = 0
+	}
+	nes.PowerOn()
+
+	frames := int(timeout * nes.Timing().FrameRate())
+	signed := false
+	resetAt := -1
+	for frame := 0; frame < frames; frame++ {
+		nes.RunFrame()
+		result.Frames = frame + 1
+
+		if !signed {
+			signed = hasTestSignature(nes)
+			if !signed {
+				continue
+			}
+		}
+
+		status := nes.CPUBus.Peek(TestAddressStatus)
+		switch {
+		case status == TestStatusRunning:
+		case status == TestStatusReset:
+			if resetAt < 0 {
+				resetAt = frame + testResetDelay
+			}
+			if frame >= resetAt {
+				nes.Reset()
+				resetAt = -1
+			}
+		case status < TestStatusRunning:
+			result.Code = int(status)
+			result.Message = readTestText(nes)
+			return result, nil
+		}
+	}
+
+	if !signed {
+		return result, fmt.Errorf("%s: no result signature at $%04X after %d frames", file, TestAddressSignature, frames)
+	}
+	result.Message = readTestText(nes)
+	return result, fmt.Errorf("%s: timed out after %d frames", file, frames)
+}
+
+func hasTestSignature(nes *NES) bool {
+	for i, b := range testSignature {
+		if nes.CPUBus.Peek(TestAddressSignature+uint16(i)) != b {
+			return false
+		}
+	}
+	return true
+}
+
+func readTestText(nes *NES) string {
+	var b strings.Builder
+	for addr := uint16(TestAddressText); addr < 0x8000; addr++ {
+		c := nes.CPUBus.Peek(addr)
+		if c == 0 {
+			break
+		}
+		b.WriteByte(c)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// testCommand runs test ROMs and reports which of them passed.
+func testCommand(args []string) error {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	configFlags := NewConfigFlags(fs)
+	timeout := fs.Float64("timeout", DefaultTestTimeout, "seconds of emulated time each ROM may run")
+	verbose := fs.Bool("v", false, "print the message of passing ROMs too")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: nes test [flags] rom.nes...")
+	}
+
+	config, err := configFlags.Config()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, file := range fs.Args() {
+		result, err := RunTestROM(file, config, *timeout)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("ERROR %v\n", err)
+		case result.Passed():
+			fmt.Printf("PASS  %s\n", file)
+			if *verbose && result.Message != "" {
+				fmt.Println(indentText(result.Message))
+			}
+		default:
+			failed++
+			fmt.Printf("FAIL  %s (code %d)\n", file, result.Code)
+			if result.Message != "" {
+				fmt.Println(indentText(result.Message))
+			}
+		}
+	}
+
+	fmt.Printf("%d/%d passed\n", fs.NArg()-failed, fs.NArg())
+	if failed > 0 {
+		return fmt.Errorf("%d of %d test ROMs failed", failed, fs.NArg())
+	}
+	return nil
+}
+
+func indentText(s string) string {
+	return "      " + strings.Replace(s, "\n", "\n      ", -1)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestROMs runs test ROMs from $NES_TEST_ROMS, laid out like the
+// nes-test-roms collection, defaulting to testdata/nes-test-roms. ROMs
+// that are not there are skipped.
+func TestROMs(t *testing.T) {
+	dir := os.Getenv("NES_TEST_ROMS")
+	if dir == "" {
+		dir = filepath.Join("testdata", "nes-test-roms")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Skipf("no test ROMs: %v", err)
+	}
+
+	// suites that cannot pass yet are skipped with the reason
+	noAPU := "the APU only stores register writes"
+	tests := []struct {
+		rom  string
+		skip string
+	}{
+		{"cpu_instrs/cpu_instrs.nes", ""},
+		{"instr_test-v5/rom_singles/01-basics.nes", ""},
+		{"instr_test-v5/rom_singles/02-implied.nes", ""},
+		{"instr_test-v5/rom_singles/03-immediate.nes", ""},
+		{"instr_test-v5/rom_singles/04-zero_page.nes", ""},
+		{"instr_test-v5/rom_singles/05-zp_xy.nes", ""},
+		{"instr_test-v5/rom_singles/06-absolute.nes", ""},
+		{"instr_test-v5/rom_singles/07-abs_xy.nes", ""},
+		{"instr_test-v5/rom_singles/08-ind_x.nes", ""},
+		{"instr_test-v5/rom_singles/09-ind_y.nes", ""},
+		{"instr_test-v5/rom_singles/10-branches.nes", ""},
+		{"instr_test-v5/rom_singles/11-stack.nes", ""},
+		{"instr_test-v5/rom_singles/12-jmp_jsr.nes", ""},
+		{"instr_test-v5/rom_singles/13-rts.nes", ""},
+		{"instr_test-v5/rom_singles/14-rti.nes", ""},
+		{"instr_test-v5/rom_singles/15-brk.nes", ""},
+		{"instr_test-v5/rom_singles/16-special.nes", ""},
+		{"instr_timing/instr_timing.nes", "instr_timing times instructions with the APU length counter; " + noAPU},
+		{"ppu_vbl_nmi/rom_singles/01-vbl_basics.nes", ""},
+		{"oam_read/oam_read.nes", ""},
+		{"sprite_hit_tests_2005.10.05/01.basics.nes", "sprite_hit_tests report on screen, not through $6000"},
+		{"apu_test/apu_test.nes", noAPU},
+		{"mmc3_test/1-clocking.nes", "MMC3 (mapper 4) is not implemented"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.rom, func(t *testing.T) {
+			if tt.skip != "" {
+				t.Skip(tt.skip)
+			}
+			file := filepath.Join(dir, filepath.FromSlash(tt.rom))
+			if _, err := os.Stat(file); err != nil {
+				t.Skip(err)
+			}
+			result, err := RunTestROM(file, Config{SaveDir: t.TempDir()}, DefaultTestTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Passed() {
+				t.Errorf("code %d: %s", result.Code, result.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Tracer writes a line in the nestest.log format before every
+// instruction:
+//
+//	C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7
+//
+// With Symbols set, the name and source line of PC are appended after a
+// semicolon.
+type Tracer struct {
+	w   *bufio.Writer
+	err error
+
+	Symbols *Symbols
+}
+
+func NewTracer(w io.Writer) *Tracer {
+	return &Tracer{w: bufio.NewWriter(w)}
+}
+
+// Trace writes the line for the instruction at c.PC.
+func (t *Tracer) Trace(c *cpu) {
+	if t.err != nil {
+		return
+	}
+	line := TraceLine(c)
+	if t.Symbols != nil {
+		if where := describePC(t.Symbols, c.PC, prgOffset(c.MMC, c.PC)); where != "" {
+			line += " ; " + where
+		}
+	}
+	_, t.err = io.WriteString(t.w, line+"\n")
+}
+
+// describePC names an address and the source line assembled there, as
+// far as symbols know them.
+func describePC(symbols *Symbols, addr uint16, offset int) string {
+	var parts []string
+	if name := symbols.Name(addr, offset); name != "" {
+		parts = append(parts, name)
+	}
+	if line, ok := symbols.Line(offset); ok {
+		parts = append(parts, line.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// Flush writes out buffered lines and returns the first write error.
+func (t *Tracer) Flush() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.w.Flush()
+}
+
+// SetTracer starts tracing every instruction to t, or stops with nil.
+func (n *NES) SetTracer(t *Tracer) {
+	n.CPU.tracer = t
+}
+
+// TraceLine formats the instruction at c.PC and the machine state before
+// it runs as a nestest.log line.
+func TraceLine(c *cpu) string {
+	opcode := c.bus.Peek(c.PC)
+	size := instruction_sizes[opcode]
+	if size == 0 {
+		size = 1
+	}
+
+	raw := make([]string, size)
+	for i := range raw {
+		raw[i] = fmt.Sprintf("%02X", c.bus.Peek(c.PC+uint16(i)))
+	}
+
+	marker := " "
+	if isUnofficial(opcode) {
+		marker = "*"
+	}
+
+	return fmt.Sprintf("%04X  %-9s%s%-32sA:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d",
+		c.PC,
+		strings.Join(raw, " "),
+		marker,
+		traceInstruction(c, opcode),
+		c.A, c.X, c.Y, c.P, c.S,
+		c.PPU.Line, c.PPU.Cycle,
+		c.Cycle,
+	)
+}
+
+// traceInstruction disassembles the instruction at c.PC and resolves its
+// operand against the current registers and memory.
+func traceInstruction(c *cpu, opcode byte) string {
+	name := traceName(opcode)
+	arg8 := c.bus.Peek(c.PC + 1)
+	arg16 := uint16(arg8) | uint16(c.bus.Peek(c.PC+2))<<8
+
+	switch instruction_modes[opcode] {
+	case modeImplied:
+		return name
+	case modeAccumulator:
+		return name + " A"
+	case modeImmediate:
+		return fmt.Sprintf("%s #$%02X", name, arg8)
+	case modeZeroPage:
+		return fmt.Sprintf("%s $%02X = %02X", name, arg8, traceRead(c, uint16(arg8)))
+	case modeZeroPageX:
+		addr := uint16(arg8 + c.X)
+		return fmt.Sprintf("%s $%02X,X @ %02X = %02X", name, arg8, addr, traceRead(c, addr))
+	case modeZeroPageY:
+		addr := uint16(arg8 + c.Y)
+		return fmt.Sprintf("%s $%02X,Y @ %02X = %02X", name, arg8, addr, traceRead(c, addr))
+	case modeAbsolute:
+		if name == "JMP" || name == "JSR" {
+			return fmt.Sprintf("%s $%04X", name, arg16)
+		}
+		return fmt.Sprintf("%s $%04X = %02X", name, arg16, traceRead(c, arg16))
+	case modeAbsoluteX:
+		addr := arg16 + uint16(c.X)
+		return fmt.Sprintf("%s $%04X,X @ %04X = %02X", name, arg16, addr, traceRead(c, addr))
+	case modeAbsoluteY:
+		addr := arg16 + uint16(c.Y)
+		return fmt.Sprintf("%s $%04X,Y @ %04X = %02X", name, arg16, addr, traceRead(c, addr))
+	case modeIndirect:
+		return fmt.Sprintf("%s ($%04X) = %04X", name, arg16, traceRead16(c, arg16))
+	case modeIndexedIndirect:
+		ptr := arg8 + c.X
+		addr := traceRead16(c, uint16(ptr))
+		return fmt.Sprintf("%s ($%02X,X) @ %02X = %04X = %02X", name, arg8, ptr, addr, traceRead(c, addr))
+	case modeIndirectIndexed:
+		base := traceRead16(c, uint16(arg8))
+		addr := base + uint16(c.Y)
+		return fmt.Sprintf("%s ($%02X),Y = %04X @ %04X = %02X", name, arg8, base, addr, traceRead(c, addr))
+	case modeRelative:
+		return fmt.Sprintf("%s $%04X", name, c.PC+2+uint16(int8(arg8)))
+	}
+	return name
+}
+
+// traceRead reads memory for display. Registers in $2000-$401F are
+// shown as $FF, like nestest.log does.
+func traceRead(c *cpu, addr uint16) byte {
+	if addr >= 0x2000 && addr < 0x4020 {
+		return 0xFF
+	}
+	return c.bus.Peek(addr)
+}
+
+// traceRead16 reads a pointer the way the CPU does, wrapping within the
+// page of its low byte.
+func traceRead16(c *cpu, addr uint16) uint16 {
+	hi := addr&0xFF00 | uint16(byte(addr)+1)
+	return uint16(traceRead(c, addr)) | uint16(traceRead(c, hi))<<8
+}
+
+// traceName is the mnemonic nestest.log uses for an opcode.
+func traceName(opcode byte) string {
+	name := instruction_names[opcode]
+	if name == "ISC" {
+		return "ISB"
+	}
+	return name
+}
+
+var unofficialNames = map[string]bool{
+	"SLO": true, "RLA": true, "SRE": true, "RRA": true,
+	"SAX": true, "LAX": true, "DCP": true, "ISC": true,
+	"ANC": true, "ALR": true, "ARR": true, "XAA": true,
+	"AXS": true, "AHX": true, "SHY": true, "SHX": true,
+	"TAS": true, "LAS": true, "KIL": true,
+}
+
+// isUnofficial reports whether opcode is not part of the documented
+// 6502 instruction set.
+func isUnofficial(opcode byte) bool {
+	switch opcode {
+	case 0xEA:
+		return false
+	case 0xEB:
+		return true
+	}
+	name := instruction_names[opcode]
+	return name == "NOP" || unofficialNames[name]
+}
+
+// TraceDiff is an io.Writer that compares trace lines against a
+// reference log as they are written, stopping at the first divergence.
+type TraceDiff struct {
+	ref     *bufio.Scanner
+	context int
+	ignore  *regexp.Regexp
+
+	line    int
+	matched int
+	recent  []string
+	partial string
+
+	// Divergence is set once a line differs or the reference ends.
+	Divergence *TraceDivergence
+}
+
+type TraceDivergence struct {
+	Line     int
+	Context  []string
+	Want     string
+	Got      string
+	EndOfRef bool
+}
+
+var tracePPUField = regexp.MustCompile(`PPU:\s*-?\d+,\s*-?\d+\s*`)
+
+// NewTraceDiff compares against ref, keeping context matching lines to
+// show before a divergence. With ignorePPU, the PPU dot and scanline are
+// not compared, for reference logs from emulators that count them
+// differently.
+func NewTraceDiff(ref io.Reader, context int, ignorePPU bool) *TraceDiff {
+	d := &TraceDiff{
+		ref:     bufio.NewScanner(ref),
+		context: context,
+	}
+	if ignorePPU {
+		d.ignore = tracePPUField
+	}
+	return d
+}
+
+func (d *TraceDiff) Write(p []byte) (int, error) {
+	lines := strings.Split(d.partial+string(p), "\n")
+	d.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if d.Divergence != nil {
+			break
+		}
+		d.compare(line)
+	}
+	return len(p), nil
+}
+
+func (d *TraceDiff) compare(got string) {
+	d.line++
+	if !d.ref.Scan() {
+		d.Divergence = &TraceDivergence{Line: d.line, Context: d.recent, Got: got, EndOfRef: true}
+		return
+	}
+	want := strings.TrimRight(d.ref.Text(), " \r")
+	if d.normalize(want) != d.normalize(got) {
+		d.Divergence = &TraceDivergence{Line: d.line, Context: d.recent, Want: want, Got: got}
+		return
+	}
+	d.matched++
+	d.recent = append(d.recent, got)
+	if len(d.recent) > d.context {
+		d.recent = d.recent[1:]
+	}
+}
+
+func (d *TraceDiff) normalize(line string) string {
+	// symbol annotations are not part of reference logs
+	if i := strings.Index(line, " ; "); i >= 0 {
+		line = line[:i]
+	}
+	if d.ignore != nil {
+		return d.ignore.ReplaceAllString(line, "")
+	}
+	return line
+}
+
+// Matched returns the number of lines that matched the reference.
+func (d *TraceDiff) Matched() int {
+	return d.matched
+}
+
+func (t *TraceDivergence) String() string {
+	var b strings.Builder
+	if t.EndOfRef {
+		fmt.Fprintf(&b, "reference log ends before line %d\n", t.Line)
+	} else {
+		fmt.Fprintf(&b, "first divergence at line %d\n", t.Line)
+	}
+	for _, line := range t.Context {
+		fmt.Fprintf(&b, "      %s\n", line)
+	}
+	if !t.EndOfRef {
+		fmt.Fprintf(&b, "want: %s\n", t.Want)
+	}
+	fmt.Fprintf(&b, "got:  %s\n", t.Got)
+	if !t.EndOfRef {
+		col := 0
+		for col < len(t.Want) && col < len(t.Got) && t.Want[col] == t.Got[col] {
+			col++
+		}
+		fmt.Fprintf(&b, "      %s^\n", strings.Repeat(" ", col))
+	}
+	return b.String()
+}
+
+// traceCommand runs a ROM writing a nestest.log style trace, or compares
+// the trace against a reference log.
+func traceCommand(args []string) error {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	configFlags := NewConfigFlags(fs)
+	output := fs.String("o", "", "write the trace to this file (default: stdout)")
+	compare := fs.String("compare", "", "compare the trace against this reference log")
+	context := fs.Int("context", 5, "matching lines to show before a divergence")
+	ignorePPU := fs.Bool("ignore-ppu", false, "do not compare the PPU dot and scanline")
+	nestest := fs.Bool("nestest", false, "start at $C000 like nestest's automated mode")
+	limit := fs.Int("n", 0, "stop after this many instructions (0: until the reference ends, or 1 frame)")
+	frames := fs.Int("frames", 0, "stop after this many frames")
+	symbolFiles := fs.String("symbols", "", "comma-separated .dbg, .mlb or .nl files to annotate the trace with (default: found next to the ROM)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: nes trace [flags] rom.nes")
+	}
+
+	config, err := configFlags.Config()
+	if err != nil {
+		return err
+	}
+
+	nes, err := NewNES(fs.Arg(0), NewFrameBuffer(), config)
+	if err != nil {
+		return err
+	}
+	nes.PowerOn()
+	if *nestest {
+		nes.CPU.PC = 0xC000
+		nes.CPU.P = 0x24
+		nes.CPU.S = 0xFD
+		nes.CPU.Cycle = 7
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var diff *TraceDiff
+	if *compare != "" {
+		ref, err := os.Open(*compare)
+		if err != nil {
+			return err
+		}
+		defer ref.Close()
+		diff = NewTraceDiff(ref, *context, *ignorePPU)
+		if *output == "" {
+			w = diff
+		} else {
+			w = io.MultiWriter(w, diff)
+		}
+	}
+
+	tracer := NewTracer(w)
+	if tracer.Symbols, err = LoadSymbolFiles(splitList(*symbolFiles), fs.Arg(0)); err != nil {
+		return err
+	}
+	nes.SetTracer(tracer)
+
+	if *limit == 0 && *frames == 0 && diff == nil {
+		*frames = 1
+	}
+	start := nes.PPU.Frame
+	for i := 0; *limit == 0 || i < *limit; i++ {
+		if *frames > 0 && nes.PPU.Frame-start >= *frames {
+			break
+		}
+		nes.Tick()
+		if diff != nil {
+			// the tracer buffers, so push its lines through to compare
+			if err := tracer.Flush(); err != nil {
+				return err
+			}
+			if diff.Divergence != nil {
+				break
+			}
+		}
+	}
+	if err := tracer.Flush(); err != nil {
+		return err
+	}
+
+	if diff == nil {
+		return nil
+	}
+	if d := diff.Divergence; d != nil && !(d.EndOfRef && *limit == 0) {
+		fmt.Print(d)
+		return fmt.Errorf("trace diverges from %s", *compare)
+	}
+	fmt.Printf("%d lines match %s\n", diff.Matched(), *compare)
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	UNIFMagic      = "UNIF"
+	UNIFHeaderSize = 32
+)
+
+// unifBoards maps UNIF board names, without their NES-/HVC-/UNL-
+// style prefix, to the mapper that emulates them.
+var unifBoards = map[string]int{
+	"NROM":     0,
+	"NROM-128": 0,
+	"NROM-256": 0,
+	"RROM":     0,
+	"RROM-128": 0,
+	"SAROM":    1,
+	"SBROM":    1,
+	"SCROM":    1,
+	"SEROM":    1,
+	"SFROM":    1,
+	"SGROM":    1,
+	"SHROM":    1,
+	"SJROM":    1,
+	"SKROM":    1,
+	"SLROM":    1,
+	"SL1ROM":   1,
+	"SNROM":    1,
+	"SOROM":    1,
+	"SUROM":    1,
+	"SXROM":    1,
+}
+
+var unifBoardPrefixes = []string{"NES-", "HVC-", "UNL-", "BTL-", "BMC-", "IREM-", "KONAMI-", "TAITO-"}
+
+func unifMapper(board string) (int, bool) {
+	name := strings.ToUpper(board)
+	for _, p := range unifBoardPrefixes {
+		name = strings.TrimPrefix(name, p)
+	}
+	m, ok := unifBoards[name]
+	return m, ok
+}
+
+// loadUNIF parses a UNIF image: a 32 byte header followed by chunks of
+// a 4 byte ID, a 4 byte little-endian length and the chunk data.
+func (r *rom) loadUNIF(data []byte) error {
+	if len(data) < UNIFHeaderSize {
+		return &TruncatedError{"UNIF header", UNIFHeaderSize, len(data)}
+	}
+	log.Printf("UNIF revision %d\n", binary.LittleEndian.Uint32(data[4:]))
+
+	var board string
+	var mirr *byte
+	prg := map[int][]byte{}
+	chr := map[int][]byte{}
+	battery := false
+	timing := TimingNTSC
+
+	p := data[UNIFHeaderSize:]
+	for len(p) > 0 {
+		if len(p) < 8 {
+			return &TruncatedError{"UNIF chunk header", 8, len(p)}
+		}
+		id := string(p[:4])
+		size := int(binary.LittleEndian.Uint32(p[4:]))
+		p = p[8:]
+		if size > len(p) {
+			return &TruncatedError{"UNIF chunk " + id, size, len(p)}
+		}
+		chunk := p[:size]
+		p = p[size:]
+
+		switch {
+		case id == "MAPR":
+			if i := bytes.IndexByte(chunk, 0); i >= 0 {
+				chunk = chunk[:i]
+			}
+			board = string(chunk)
+		case strings.HasPrefix(id, "PRG"), strings.HasPrefix(id, "CHR"):
+			var n int
+			if _, err := fmt.Sscanf(id[3:], "%X", &n); err != nil {
+				log.Printf("ignoring UNIF chunk %q\n", id)
+				continue
+			}
+			if id[:3] == "PRG" {
+				prg[n] = chunk
+			} else {
+				chr[n] = chunk
+			}
+		case id == "MIRR":
+			if len(chunk) > 0 {
+				mirr = &chunk[0]
+			}
+		case id == "BATR":
+			battery = true
+		case id == "TVCI":
+			if len(chunk) > 0 {
+				switch chunk[0] {
+				case 1:
+					timing = TimingPAL
+				case 2:
+					timing = TimingMulti
+				}
+			}
+		}
+	}
+
+	if board == "" {
+		return &HeaderError{"MAPR", "missing board name"}
+	}
+	mapper, ok := unifMapper(board)
+	if !ok {
+		return &HeaderError{"MAPR", fmt.Sprintf("unsupported board %q", board)}
+	}
+
+	r.PRG = joinUNIFChunks(prg)
+	r.CHR = joinUNIFChunks(chr)
+	if len(r.PRG) == 0 {
+		return &HeaderError{"PRG-ROM size", "zero"}
+	}
+
+	r.Board = board
+	r.Header = Header{
+		MapperNum:  mapper,
+		Battery:    battery,
+		Timing:     timing,
+		PRGROMSize: len(r.PRG),
+		CHRROMSize: len(r.CHR),
+	}
+	if battery {
+		r.Header.PRGNVRAMSize = PRGRAMUnit
+	} else {
+		r.Header.PRGRAMSize = PRGRAMUnit
+	}
+	if len(r.CHR) == 0 {
+		r.Header.CHRRAMSize = DefaultCHRRAM
+	}
+	if mirr != nil {
+		switch *mirr {
+		case 0:
+			r.Header.Mirroring = MirroringHorizontal
+		case 1:
+			r.Header.Mirroring = MirroringVertical
+		case 2:
+			r.Header.Mirroring = MirroringSingleScreen0
+		case 3:
+			r.Header.Mirroring = MirroringSingleScreen1
+		case 4:
+			r.Header.Mirroring = MirroringFourScreen
+		}
+	}
+
+	log.Printf("BOARD: %s\n", board)
+	log.Printf("PRG: %d, CHR: %d\n", r.Header.PRGROMSize, r.Header.CHRROMSize)
+	log.Printf("MAPPER: %d\n", r.Header.MapperNum)
+
+	r.allocateRAM()
+	return nil
+}
+
+// joinUNIFChunks concatenates numbered PRGn/CHRn chunks in order.
+func joinUNIFChunks(chunks map[int][]byte) []byte {
+	keys := make([]int, 0, len(chunks))
+	for k := range chunks {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	var res []byte
+	for _, k := range keys {
+		res = append(res, chunks[k]...)
+	}
+	return res
+}